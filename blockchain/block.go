@@ -1,68 +1,95 @@
 package blockchain
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/sha256"
 	"log"
-	"time"
 )
 
+// Fields covered by the block hash. A header can be checked against its
+// proof of work without the transactions it commits to
+type BlockHeader struct {
+	Version    int
+	PrevHash   []byte
+	MerkleRoot []byte
+	Timestamp  int64
+	Bits       uint32
+	Nonce      int
+	Height     int
+}
+
 type Block struct {
-	Timestamp    int64
+	BlockHeader
 	Hash         []byte
 	Transactions []*Transaction
-	PrevHash     []byte
-	Nonce        int
-	Height       int
 }
 
-func (b *Block) HashTransactions() []byte {
+// Returns the hash of the encoded header
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(h.Serialize())
+
+	return hash[:]
+}
+
+func (h *BlockHeader) Serialize() []byte {
+	var e encoder
+	h.encode(&e)
+
+	return e.Bytes()
+}
+
+func DeserializeHeader(data []byte) *BlockHeader {
+	header, err := DecodeHeader(data)
+	Handle(err)
+
+	return header
+}
+
+// Returns the Merkle tree of the encoded transactions, built the way the block version requires
+func (b *Block) MerkleTree() *MerkleTree {
 	var txHashes [][]byte
 
 	for _, tx := range b.Transactions {
 		txHashes = append(txHashes, tx.Serialize())
 	}
-	tree := NewMerkleTree(txHashes)
 
-	return tree.RootNode.Data
+	if b.Version < TaggedMerkleVersion {
+		return NewLegacyMerkleTree(txHashes)
+	}
+
+	return NewMerkleTree(txHashes)
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
+func (b *Block) HashTransactions() []byte {
+	return b.MerkleTree().RootNode.Data
+}
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+func CreateBlock(txs []*Transaction, prevHash []byte, height int, bits uint32, timestamp int64) *Block {
+	block := &Block{BlockHeader{BlockVersion, prevHash, nil, timestamp, bits, 0, height}, nil, txs}
+	block.MerkleRoot = block.HashTransactions()
+
+	err := NewMiner(0).Mine(context.Background(), block)
+	Handle(err)
 
 	return block
 }
 
 func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, InitialBits, AdjustedTime())
 }
 
 func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-
-	err := encoder.Encode(b)
+	var e encoder
+	b.encode(&e)
 
-	Handle(err)
-
-	return res.Bytes()
+	return e.Bytes()
 }
 
 func Deserialize(data []byte) *Block {
-	var block Block
-
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-
-	err := decoder.Decode(&block)
-
+	block, err := DecodeBlock(data)
 	Handle(err)
 
-	return &block
+	return block
 }
 
 func Handle(err error) {
@@ -0,0 +1,41 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHeaderHashCoversEveryField(t *testing.T) {
+	chain, w, _ := newTestChain(t)
+
+	block := newTestBlock(t, chain, chain.LastHash, CoinbaseTx(string(w.Address()), "", chain.GetBestHeight()+1, 0))
+	hash := block.BlockHeader.Hash()
+
+	changes := map[string]func(h *BlockHeader){
+		"timestamp": func(h *BlockHeader) { h.Timestamp++ },
+		"height":    func(h *BlockHeader) { h.Height++ },
+		"nonce":     func(h *BlockHeader) { h.Nonce++ },
+		"bits":      func(h *BlockHeader) { h.Bits-- },
+	}
+
+	for field, change := range changes {
+		header := block.BlockHeader
+		change(&header)
+		if bytes.Equal(header.Hash(), hash) {
+			t.Fatalf("changing the %s left the hash unchanged", field)
+		}
+
+		// The stated hash no longer matches the header
+		changed := *block
+		changed.BlockHeader = header
+		if err := CheckBlock(&changed); errors.Is(err, ErrBadHash) == false {
+			t.Fatalf("%s: expected %v, got %v", field, ErrBadHash, err)
+		}
+	}
+
+	// Headers relayed on their own hash the same
+	if bytes.Equal(DeserializeHeader(block.BlockHeader.Serialize()).Hash(), hash) == false {
+		t.Fatal("header does not hash the same once decoded")
+	}
+}
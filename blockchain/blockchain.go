@@ -3,28 +3,48 @@ package blockchain
 import (
 	"blockchain/main/database"
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"runtime"
+	"sync"
+	"time"
 )
 
 const (
 	dbPath      = "/tmp/blocks_%s"
 	genesisData = "First Transaction from Genesis"
+
+	// Orphans kept at most, and for how long, so peers cannot fill the memory with blocks of unknown parents
+	MaxOrphans   = 100
+	OrphanExpiry = time.Hour
 )
 
+var ErrInvalidTransaction = errors.New("transaction is not valid")
+
 type BlockChain struct {
 	LastHash []byte
-	Database *database.Database
+	Database database.Database
+
+	// Held while blocks are added, connected or reorganized, and for reading by Tip
+	mutex sync.RWMutex
+
+	// Blocks waiting for their parent, keyed by parent hash
+	orphans map[string][]orphanBlock
+}
+
+// Block waiting for its parent and when it was received
+type orphanBlock struct {
+	block    *Block
+	received time.Time
 }
 
 type ChainIterator struct {
 	CurrentHash []byte
-	Database    *database.Database
+	Database    database.Database
 }
 
 func DBExists(path string) bool {
@@ -47,23 +67,43 @@ func InitBlockChain(address, nodeId string) *BlockChain {
 	db, err := database.GetDatabase(path)
 	Handle(err)
 
+	return NewBlockChain(db, address)
+}
+
+// Creates a chain in the given database with a genesis block paying to address
+func NewBlockChain(db database.Database, address string) *BlockChain {
 	// Create coinbase transaction
-	cbtx := CoinbaseTx(address, genesisData)
+	cbtx := CoinbaseTx(address, genesisData, 0, 0)
 
 	// Create genesis block
 	genesis := Genesis(cbtx)
 	fmt.Println("Genesis created")
 
-	// Store genesis block data
-	err = db.Update(genesis.Hash, genesis.Serialize())
+	blockchain := BlockChain{LastHash: genesis.Hash, Database: db}
+	batch := db.NewBatch()
+
+	// Store genesis block data and work
+	err := storeBlock(batch, genesis, genesis.Work())
+	Handle(err)
+
+	// Add genesis outputs to the UTXO set and the block to the indexes
+	err = blockchain.connectTip(batch, genesis)
 	Handle(err)
 
 	// Set last hash as genesis block hash
-	err = db.Update([]byte("lh"), genesis.Hash)
+	err = setTip(batch, genesis)
+	Handle(err)
+
+	err = setStateVersion(batch)
+	Handle(err)
+
+	err = batch.Update(dataIndexFlagKey, []byte{})
+	Handle(err)
+
+	err = batch.Write()
 	Handle(err)
 
 	// Return chain that has only genesis block
-	blockchain := BlockChain{genesis.Hash, db}
 	return &blockchain
 }
 
@@ -78,78 +118,196 @@ func ContinueBlockChain(nodeId string) *BlockChain {
 	db, err := database.GetDatabase(path)
 	Handle(err)
 
+	return LoadBlockChain(db)
+}
+
+// Opens the chain stored in the given database
+func LoadBlockChain(db database.Database) *BlockChain {
 	// Get last block hash
 	lastHash, err := db.Read([]byte("lh"))
 	Handle(err)
 
-	chain := BlockChain{lastHash, db}
+	chain := BlockChain{LastHash: lastHash, Database: db}
+	chain.recover()
+
 	return &chain
 }
 
+// Mines a block of the given transactions on top of the tip and connects it
 func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
+	block, err := chain.MineBlockContext(context.Background(), NewMiner(0), transactions)
+	Handle(err)
+
+	return block
+}
+
+// Mines a block with the given miner and connects it. Mining stops with the context error
+// when ctx is cancelled, and ErrNotTip is returned if another block became the tip meanwhile
+func (chain *BlockChain) MineBlockContext(ctx context.Context, miner *Miner, transactions []*Transaction) (*Block, error) {
 	for _, tx := range transactions {
 		if chain.VerifyTransaction(tx) != true {
-			log.Panic("Invalid Transaction")
+			return nil, ErrInvalidTransaction
 		}
 	}
 
 	// Get last block hash
 	lastHash, err := chain.Database.Read([]byte("lh"))
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
-	// Get serialized last block data
-	lastBlockBytes, err := chain.Database.Read(lastHash)
-	Handle(err)
+	lastHeader, err := chain.GetBlockHeader(lastHash)
+	if err != nil {
+		return nil, err
+	}
 
-	// Deserialize byte data to block
-	lastBlock := *Deserialize(lastBlockBytes)
+	// Get the target the new block must meet
+	bits, err := chain.NextBits(&lastHeader)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create new block
-	newBlock := CreateBlock(transactions, lastHash, lastBlock.Height+1)
+	// The timestamp must be later than the median time past of the last blocks
+	medianTime, err := chain.MedianTimePast(&lastHeader)
+	if err != nil {
+		return nil, err
+	}
 
-	// Store new block
-	err = chain.Database.Update(newBlock.Hash, newBlock.Serialize())
-	Handle(err)
+	timestamp := AdjustedTime()
+	if timestamp <= medianTime {
+		timestamp = medianTime + 1
+	}
 
-	// Update last block hash
-	err = chain.Database.Update([]byte("lh"), newBlock.Hash)
-	Handle(err)
+	newBlock := &Block{BlockHeader{BlockVersion, lastHash, nil, timestamp, bits, 0, lastHeader.Height + 1}, nil, transactions}
+	newBlock.MerkleRoot = newBlock.HashTransactions()
+
+	if err := miner.Mine(ctx, newBlock); err != nil {
+		return nil, err
+	}
+
+	// Store new block, update the UTXO set and make it the tip
+	if err := chain.ConnectBlock(newBlock); err != nil {
+		return nil, err
+	}
 
-	chain.LastHash = newBlock.Hash
+	return newBlock, nil
+}
+
+// Adds a block received from the network. The block is kept as an orphan until its parent is known,
+// and the chain switches to its branch when that branch has the most cumulative work.
+// Blocks breaking a consensus rule are rejected with a *ValidationError
+func (chain *BlockChain) AddBlock(block *Block) error {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
 
-	return newBlock
+	return chain.addBlock(block)
 }
 
-func (chain *BlockChain) AddBlock(block *Block) {
+func (chain *BlockChain) addBlock(block *Block) error {
+	if chain.isInvalid(block.Hash) {
+		return ruleError(block, ErrInvalidBranch)
+	}
 
 	// If the chain already has this block, cancel the process
 	_, err := chain.Database.Read(block.Hash)
 	if err == nil {
-		return
+		return nil
 	}
 
-	// Store new block
-	err = chain.Database.Update(block.Hash, block.Serialize())
-	Handle(err)
+	if err := CheckBlock(block); err != nil {
+		return err
+	}
 
-	// Get last block hash
-	lastHash, err := chain.Database.Read([]byte("lh"))
-	Handle(err)
+	// Blocks extending an invalid branch are invalid too
+	if chain.isInvalid(block.PrevHash) {
+		chain.markInvalid([]*Block{block})
+		return ruleError(block, ErrInvalidBranch)
+	}
 
-	// Get serialized last block data
-	lastBlockData, err := chain.Database.Read(lastHash)
-	Handle(err)
+	// If the parent is unknown, wait until it arrives
+	if _, err := chain.Database.Read(block.PrevHash); err != nil {
+		chain.addOrphan(block, time.Now())
+		return nil
+	}
 
-	// Deserialize byte data to block
-	lastBlock := Deserialize(lastBlockData)
+	if err := chain.acceptBlock(block); err != nil {
+		return err
+	}
 
-	// If block height is bigger than last block height, set it as the last block
-	if block.Height > lastBlock.Height {
-		err := chain.Database.Update([]byte("lh"), block.Hash)
-		Handle(err)
+	// Accept orphans that were waiting for this block. They were sent on their own,
+	// so one failing neither stops the others nor rejects this block
+	children := chain.orphans[string(block.Hash)]
+	delete(chain.orphans, string(block.Hash))
+
+	for _, orphan := range children {
+		if err := chain.addBlock(orphan.block); err != nil {
+			fmt.Printf("Orphan block %x rejected: %s\n", orphan.block.Hash, err)
+		}
+	}
+
+	return nil
+}
+
+// Keeps a block until its parent arrives. Expired orphans are dropped first,
+// then the oldest one if MaxOrphans are already kept
+func (chain *BlockChain) addOrphan(block *Block, now time.Time) {
+	if chain.orphans == nil {
+		chain.orphans = make(map[string][]orphanBlock)
+	}
+
+	var oldest *orphanBlock
+	count := 0
+
+	for parentHash, siblings := range chain.orphans {
+		var kept []orphanBlock
+		for _, orphan := range siblings {
+			if bytes.Equal(orphan.block.Hash, block.Hash) {
+				return
+			}
+			if now.Sub(orphan.received) >= OrphanExpiry {
+				continue
+			}
+			kept = append(kept, orphan)
+		}
+
+		if len(kept) == 0 {
+			delete(chain.orphans, parentHash)
+			continue
+		}
+		chain.orphans[parentHash] = kept
+
+		for i := range kept {
+			if oldest == nil || kept[i].received.Before(oldest.received) {
+				oldest = &kept[i]
+			}
+		}
+		count += len(kept)
+	}
 
-		chain.LastHash = block.Hash
+	if count >= MaxOrphans {
+		chain.removeOrphan(oldest.block)
 	}
+
+	parentHash := string(block.PrevHash)
+	chain.orphans[parentHash] = append(chain.orphans[parentHash], orphanBlock{block, now})
+}
+
+func (chain *BlockChain) removeOrphan(block *Block) {
+	parentHash := string(block.PrevHash)
+	siblings := chain.orphans[parentHash]
+
+	for i, orphan := range siblings {
+		if bytes.Equal(orphan.block.Hash, block.Hash) {
+			siblings = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(chain.orphans, parentHash)
+		return
+	}
+	chain.orphans[parentHash] = siblings
 }
 
 func (chain *BlockChain) GetBlockHashes() [][]byte {
@@ -174,26 +332,46 @@ func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	blockData, err := chain.Database.Read(blockHash)
 
 	if err != nil {
-		log.Panic("block is not found")
+		return Block{}, err
 	}
 
-	return *Deserialize(blockData), err
+	return *Deserialize(blockData), nil
+}
+
+// Reads only the header of a stored block
+func (chain *BlockChain) GetBlockHeader(blockHash []byte) (BlockHeader, error) {
+	blockData, err := chain.Database.Read(blockHash)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	// The encoded header is the start of the encoded block
+	d := &decoder{data: blockData}
+	header := decodeHeader(d)
+
+	return header, d.err
 }
 
 func (chain *BlockChain) GetBestHeight() int {
 	lastHash, err := chain.Database.Read([]byte("lh"))
 	Handle(err)
 
-	lastBlockData, err := chain.Database.Read(lastHash)
+	lastHeader, err := chain.GetBlockHeader(lastHash)
 	Handle(err)
 
-	lastBlock := *Deserialize(lastBlockData)
+	return lastHeader.Height
+}
+
+// Returns the hash of the last block of the main chain
+func (chain *BlockChain) Tip() []byte {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
 
-	return lastBlock.Height
+	return chain.LastHash
 }
 
 func (chain *BlockChain) Iterator() *ChainIterator {
-	return &ChainIterator{chain.LastHash, chain.Database}
+	return &ChainIterator{chain.Tip(), chain.Database}
 }
 
 func (iter *ChainIterator) Next() *Block {
@@ -206,10 +384,10 @@ func (iter *ChainIterator) Next() *Block {
 	return block
 }
 
-// Finds unspent transaction outputs
+// Finds unspent transaction outputs, keyed by their UTXO set key
 // Unspent means that these outputs were not referenced in any inputs
-func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
-	UTXO := make(map[string]TxOutputs)
+func (chain *BlockChain) FindUTXO() map[string]UTXOEntry {
+	UTXO := make(map[string]UTXOEntry)
 	spentTXOs := make(map[string][]int)
 
 	iter := chain.Iterator()
@@ -232,9 +410,7 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 					}
 				}
 
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
+				UTXO[string(utxoKey(tx.ID, outIdx))] = UTXOEntry{out, block.Height, tx.IsCoinbase()}
 			}
 
 			if tx.IsCoinbase() == false {
@@ -323,27 +499,30 @@ Work:
 	return accumulated, unspentOuts
 }
 
+// Finds a main chain transaction through the transaction index
 func (chain *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
-	iter := chain.Iterator()
+	tx, _, err := chain.lookupTransaction(chain.Database, ID)
 
-	for {
-		block := iter.Next()
+	return tx, err
+}
 
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-		}
+func (chain *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
+	tx.Sign(privateKey, chain.previousTransactions(tx))
+}
 
-		if len(block.PrevHash) == 0 {
-			break
-		}
-	}
+// Adds the signature of the private key to the inputs spending outputs of the multisig redeem script.
+// Returns the number of inputs signed
+func (chain *BlockChain) SignMultisigTransaction(tx *Transaction, privateKey ecdsa.PrivateKey, redeemScript []byte) int {
+	return tx.SignMultisig(privateKey, redeemScript, chain.previousTransactions(tx))
+}
 
-	return Transaction{}, errors.New("transaction does not exist")
+// Returns the number of signatures the multisig inputs of the transaction still need
+func (chain *BlockChain) MissingSignatures(tx *Transaction) int {
+	return tx.MissingSignatures(chain.previousTransactions(tx))
 }
 
-func (chain *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
+// Returns the transactions whose outputs the inputs spend, keyed by hex encoded ID
+func (chain *BlockChain) previousTransactions(tx *Transaction) map[string]Transaction {
 	prevTXs := make(map[string]Transaction)
 
 	// Iterate previous transactions
@@ -353,27 +532,83 @@ func (chain *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.Priva
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	tx.Sign(privateKey, prevTXs)
+	return prevTXs
 }
 
-func (chain *BlockChain) VerifyTransaction(tx *Transaction) bool {
+// Returns the fee paid by the transaction, the value of its inputs minus the value of its outputs
+func (chain *BlockChain) TransactionFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
 
+	inputValue := 0
+
+	for _, in := range tx.Inputs {
+		prevTX, err := chain.FindTransaction(in.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return 0, ErrMissingInput
+		}
+
+		var ok bool
+		inputValue, ok = addValues(inputValue, prevTX.Outputs[in.Out].Value)
+		if ok == false {
+			return 0, ErrBadValue
+		}
+	}
+
+	return transactionFee(tx, inputValue)
+}
+
+// Reports whether the transaction can be mined in the next block. Spending outputs the chain
+// does not have, or failing to read the chain, makes it not valid rather than failing
+func (chain *BlockChain) VerifyTransaction(tx *Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
 
+	// Older versions are only accepted in blocks, since anyone relaying them could change their ID
+	if tx.Version < StableIDVersion {
+		return false
+	}
+
+	if tx.CheckDataOutputs() == false {
+		return false
+	}
+
+	// Outputs may not create coins or hold amounts out of range
+	if _, err := chain.TransactionFee(tx); err != nil {
+		return false
+	}
+
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
-		fmt.Println("TX: " + hex.EncodeToString(tx.ID) + "\nInput Prev: " + hex.EncodeToString(in.ID))
-
 		prevTX, err := chain.FindTransaction(in.ID)
-		Handle(err)
-
-		fmt.Println("Tx in DB: " + hex.EncodeToString(prevTX.ID))
+		if err != nil {
+			return false
+		}
 
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	return tx.Verify(prevTXs)
+	// The transaction is checked for the next block
+	if chain.CheckLocks(tx) != nil {
+		return false
+	}
+
+	lastHeader, err := chain.GetBlockHeader(chain.Tip())
+	if err != nil {
+		return false
+	}
+
+	medianTime, err := chain.MedianTimePast(&lastHeader)
+	if err != nil {
+		return false
+	}
+
+	return tx.Verify(prevTXs, lastHeader.Height+1, medianTime) == nil
 }
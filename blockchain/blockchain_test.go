@@ -0,0 +1,374 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"blockchain/main/wallet"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Opens a second chain from a copy of the database of the first
+func copyTestChain(t *testing.T, chain *BlockChain) *BlockChain {
+	db := database.NewMemoryDatabase()
+
+	err := chain.Database.Iterate([]byte{}, func(key, val []byte) error {
+		return db.Update(key, val)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return LoadBlockChain(db)
+}
+
+func TestConcurrentBlocksReachOneTip(t *testing.T) {
+	chain, w, _ := newTestChain(t)
+	other := copyTestChain(t, chain)
+
+	blocks := mineTestBlocks(chain, w, 8)
+
+	var wg sync.WaitGroup
+	for i := len(blocks) - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(block *Block) {
+			defer wg.Done()
+			if err := other.AddBlock(block); err != nil {
+				t.Error(err)
+			}
+		}(blocks[i])
+	}
+	wg.Wait()
+
+	if bytes.Equal(other.Tip(), chain.Tip()) == false {
+		t.Fatal("chains did not reach the same tip")
+	}
+
+	UTXO, otherUTXO := UTXOSet{chain}, UTXOSet{other}
+	if UTXO.TotalSupply() != otherUTXO.TotalSupply() {
+		t.Fatal("UTXO sets differ", UTXO.TotalSupply(), otherUTXO.TotalSupply())
+	}
+}
+
+func TestConnectOnlyExtendsTip(t *testing.T) {
+	chain, w, _ := newTestChain(t)
+	parent := chain.Tip()
+
+	a := newTestBlock(t, chain, parent, CoinbaseTx(string(w.Address()), "a", chain.GetBestHeight()+1, 0))
+	b := newTestBlock(t, chain, parent, CoinbaseTx(string(w.Address()), "b", chain.GetBestHeight()+1, 0))
+
+	errs := make(chan error, 2)
+	for _, block := range []*Block{a, b} {
+		go func(block *Block) {
+			errs <- chain.ConnectBlock(block)
+		}(block)
+	}
+
+	first, second := <-errs, <-errs
+	if (first == nil) == (second == nil) {
+		t.Fatal("expected exactly one block to connect", first, second)
+	}
+	if first != ErrNotTip && second != ErrNotTip {
+		t.Fatal("expected the other block to be refused with", ErrNotTip)
+	}
+}
+
+func TestOrphansAreBoundedAndExpire(t *testing.T) {
+	chain, _, _ := newTestChain(t)
+	now := time.Now()
+
+	var first *Block
+	for i := 0; i <= MaxOrphans; i++ {
+		block := &Block{BlockHeader: BlockHeader{PrevHash: []byte{byte(i % 3)}}, Hash: []byte{1, byte(i)}}
+		if first == nil {
+			first = block
+		}
+		chain.addOrphan(block, now.Add(time.Duration(i)*time.Second))
+	}
+
+	count := 0
+	for _, siblings := range chain.orphans {
+		for _, orphan := range siblings {
+			if bytes.Equal(orphan.block.Hash, first.Hash) {
+				t.Fatal("oldest orphan was kept past the limit")
+			}
+			count++
+		}
+	}
+	if count != MaxOrphans {
+		t.Fatal("expected", MaxOrphans, "orphans, got", count)
+	}
+
+	last := &Block{BlockHeader: BlockHeader{PrevHash: []byte{9}}, Hash: []byte{2}}
+	chain.addOrphan(last, now.Add(OrphanExpiry+time.Duration(MaxOrphans)*time.Second))
+
+	if len(chain.orphans) != 1 || len(chain.orphans[string(last.PrevHash)]) != 1 {
+		t.Fatal("expired orphans were kept")
+	}
+}
+
+func TestOrphansAreAllProcessed(t *testing.T) {
+	chain, w, _ := newTestChain(t)
+	other := copyTestChain(t, chain)
+	address := string(w.Address())
+
+	parent := mineTestBlocks(chain, w, 1)[0]
+
+	// The first child claims more than the subsidy, the second is valid
+	invalid := newTestBlock(t, chain, parent.Hash, CoinbaseTx(address, "invalid", parent.Height+1, 1))
+	valid := newTestBlock(t, chain, parent.Hash, CoinbaseTx(address, "valid", parent.Height+1, 0))
+
+	for _, block := range []*Block{invalid, valid, parent} {
+		if err := other.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if bytes.Equal(other.Tip(), valid.Hash) == false {
+		t.Fatal("valid orphan was not connected after its invalid sibling")
+	}
+}
+
+func TestInvalidBranchIsRejected(t *testing.T) {
+	chain, w, _ := newTestChain(t)
+	address := string(w.Address())
+	fork := chain.Tip()
+
+	mainBlocks := mineTestBlocks(chain, w, 3)
+	lastHash := chain.Tip()
+
+	// A branch starting with a block claiming more than the subsidy, stored while it has less work
+	invalid := newTestBlock(t, chain, fork, CoinbaseTx(address, "invalid", mainBlocks[0].Height, 1))
+	branch := []*Block{invalid}
+	for {
+		if err := chain.AddBlock(branch[len(branch)-1]); err != nil {
+			t.Fatal(err)
+		}
+
+		parent := branch[len(branch)-1]
+		branch = append(branch, newTestBlock(t, chain, parent.Hash, CoinbaseTx(address, "", parent.Height+1, 0)))
+		if len(branch) == 4 {
+			break
+		}
+	}
+
+	// Extension of the branch, made on a copy where the branch is not heavier than the main chain
+	other := copyTestChain(t, chain)
+	mineTestBlocks(other, w, 1)
+	if err := other.AddBlock(branch[3]); err != nil {
+		t.Fatal(err)
+	}
+	extension := newTestBlock(t, other, branch[3].Hash, CoinbaseTx(address, "", branch[3].Height+1, 0))
+
+	var validationErr *ValidationError
+	if err := chain.AddBlock(branch[3]); errors.As(err, &validationErr) == false || errors.Is(err, ErrBadValue) == false {
+		t.Fatalf("expected %v, got %v", ErrBadValue, err)
+	}
+	if bytes.Equal(chain.Tip(), lastHash) == false {
+		t.Fatal("tip moved to the invalid branch")
+	}
+
+	for _, block := range append(branch, extension) {
+		if err := chain.AddBlock(block); errors.As(err, &validationErr) == false || errors.Is(err, ErrInvalidBranch) == false {
+			t.Fatalf("expected %v, got %v", ErrInvalidBranch, err)
+		}
+	}
+}
+
+func TestReorganizationRestoresSpentOutputs(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	address := string(w.Address())
+	to := wallet.MakeWallet()
+	fork := chain.Tip()
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(20, string(to.Address())))
+	spending := chain.MineBlock([]*Transaction{CoinbaseTx(address, "", chain.GetBestHeight()+1, 0), tx})
+
+	UTXO := UTXOSet{chain}
+	if len(UTXO.FindUnspentTransactions(wallet.PublicKeyHash(to.PublicKey))) != 1 {
+		t.Fatal("spend is not in the UTXO set")
+	}
+
+	// A heavier branch from before the spend
+	parentHash := fork
+	for i := 0; i < 2; i++ {
+		parent, err := chain.GetBlockHeader(parentHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block := newTestBlock(t, chain, parentHash, CoinbaseTx(address, "branch", parent.Height+1, 0))
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		parentHash = block.Hash
+	}
+
+	if bytes.Equal(chain.Tip(), parentHash) == false {
+		t.Fatal("chain did not switch to the heavier branch")
+	}
+	if len(UTXO.FindUnspentTransactions(wallet.PublicKeyHash(to.PublicKey))) != 0 {
+		t.Fatal("outputs of the disconnected spend are still unspent")
+	}
+	if _, err := chain.Database.Read(undoKey(spending.Hash)); err == nil {
+		t.Fatal("undo data of the disconnected block is kept")
+	}
+
+	// The spent output is back, so the spend is valid again
+	if chain.VerifyTransaction(tx) == false {
+		t.Fatal("output spent by the disconnected block was not restored")
+	}
+}
+
+// Adds blocks paying their coinbase to the address on top of the parent
+func addTestBranch(t *testing.T, chain *BlockChain, address string, parentHash []byte, count int) []*Block {
+	var blocks []*Block
+	for i := 0; i < count; i++ {
+		parent, err := chain.GetBlockHeader(parentHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block := newTestBlock(t, chain, parentHash, CoinbaseTx(address, "branch", parent.Height+1, 0))
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		parentHash = block.Hash
+	}
+
+	return blocks
+}
+
+func TestIndexesFollowReorganization(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	address := string(w.Address())
+	fork := chain.Tip()
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(20, address))
+	chain.MineBlock([]*Transaction{CoinbaseTx(address, "", chain.GetBestHeight()+1, 0), tx})
+
+	if _, err := chain.FindTransaction(tx.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	branch := addTestBranch(t, chain, address, fork, 2)
+
+	for _, block := range branch {
+		indexed, err := chain.GetBlockByHeight(block.Height)
+		if err != nil || bytes.Equal(indexed.Hash, block.Hash) == false {
+			t.Fatal("height index does not point to the new branch", block.Height, err)
+		}
+
+		if _, err := chain.FindTransaction(block.Transactions[0].ID); err != nil {
+			t.Fatal("transaction of the new branch is not found:", err)
+		}
+	}
+
+	if _, err := chain.FindTransaction(tx.ID); errors.Is(err, ErrTxNotFound) == false {
+		t.Fatalf("expected %v, got %v", ErrTxNotFound, err)
+	}
+}
+
+func prefixContents(t *testing.T, db database.Database, prefixes ...[]byte) map[string]string {
+	contents := make(map[string]string)
+
+	for _, prefix := range prefixes {
+		err := db.Iterate(prefix, func(key, val []byte) error {
+			contents[string(key)] = string(val)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return contents
+}
+
+func TestDisconnectRestoresOutputsSpentInTheBlock(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	address := string(w.Address())
+	before := prefixContents(t, chain.Database, utxoPrefix, addrUTXOPrefix)
+
+	// The second transaction spends the output of the first in the same block
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(20, address))
+	child := &Transaction{nil, TxVersion, []TxInput{{tx.ID, 0, nil, inputSequence(0)}}, []TxOutput{*NewTXOutput(20, address)}, 0}
+	child.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(tx.ID): *tx})
+	child.ID = child.Hash()
+
+	block := newTestBlock(t, chain, chain.LastHash, CoinbaseTx(address, "", chain.GetBestHeight()+1, 0), tx, child)
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := chain.Database.NewBatch()
+	UTXO := UTXOSet{chain}
+	if err := UTXO.DisconnectBlock(batch, block); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sameContents(before, prefixContents(t, chain.Database, utxoPrefix, addrUTXOPrefix)) == false {
+		t.Fatal("disconnecting the block did not restore the UTXO set")
+	}
+}
+
+func TestOutputsAreSpentOneByOne(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	address := string(w.Address())
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(5, address), *NewTXOutput(15, address))
+	chain.MineBlock([]*Transaction{CoinbaseTx(address, "", chain.GetBestHeight()+1, 0), tx})
+
+	// Spends only the first output
+	spend := newTestSpend(chain, w, tx, *NewTXOutput(5, address))
+	chain.MineBlock([]*Transaction{CoinbaseTx(address, "", chain.GetBestHeight()+1, 0), spend})
+
+	if entry, err := findUnspent(chain.Database, tx.ID, 0); err != nil || entry != nil {
+		t.Fatal("spent output is still unspent", err)
+	}
+	entry, err := findUnspent(chain.Database, tx.ID, 1)
+	if err != nil || entry == nil || entry.Output.Value != 15 {
+		t.Fatal("output left unspent was removed", err)
+	}
+}
+
+func TestAddressIndexFollowsSpendsAndDisconnects(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	address := string(w.Address())
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	to := wallet.MakeWallet()
+	toHash := wallet.PublicKeyHash(to.PublicKey)
+	fork := chain.Tip()
+
+	spentKey := addrUTXOKey(pubKeyHash, first.Transactions[0].ID, 0)
+	if _, err := chain.Database.Read(spentKey); err != nil {
+		t.Fatal("unspent output is not in the address index")
+	}
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(20, string(to.Address())))
+	chain.MineBlock([]*Transaction{CoinbaseTx(address, "", chain.GetBestHeight()+1, 0), tx})
+
+	if _, err := chain.Database.Read(spentKey); err == nil {
+		t.Fatal("spent output is still in the address index")
+	}
+	receivedKey := addrUTXOKey(toHash, tx.ID, 0)
+	if _, err := chain.Database.Read(receivedKey); err != nil {
+		t.Fatal("new output is not in the address index")
+	}
+
+	addTestBranch(t, chain, address, fork, 2)
+
+	if _, err := chain.Database.Read(receivedKey); err == nil {
+		t.Fatal("output of the disconnected block is still in the address index")
+	}
+	if _, err := chain.Database.Read(spentKey); err != nil {
+		t.Fatal("output restored by the disconnect is not in the address index")
+	}
+}
@@ -0,0 +1,163 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	// Hash of the block the UTXO set was last brought up to
+	utxoTipKey = []byte("ut")
+
+	// Transaction version whose outputs the UTXO set and the undo data are stored as
+	stateVersionKey = []byte("sv")
+
+	ErrNotTip = errors.New("block does not extend the chain tip")
+)
+
+// Adds the block with the given cumulative work to the batch
+func storeBlock(batch database.Batch, block *Block, work *big.Int) error {
+	if err := batch.Update(block.Hash, block.Serialize()); err != nil {
+		return err
+	}
+
+	return batch.Update(workKey(block.Hash), work.Bytes())
+}
+
+// Records that the UTXO set and the undo data hold outputs with locking scripts
+func setStateVersion(batch database.Batch) error {
+	return batch.Update(stateVersionKey, ToHex(ScriptTxVersion))
+}
+
+// Moves the chain tip and the UTXO set tip to the given block
+func setTip(batch database.Batch, block *Block) error {
+	if err := batch.Update([]byte("lh"), block.Hash); err != nil {
+		return err
+	}
+
+	return batch.Update(utxoTipKey, block.Hash)
+}
+
+// Checks the block against the UTXO set in the batch and applies its UTXO and index changes
+func (chain *BlockChain) connectTip(batch database.Batch, block *Block) error {
+	if err := chain.checkBlockInputs(batch, block); err != nil {
+		return err
+	}
+
+	return chain.applyBlock(batch, block)
+}
+
+// Applies the UTXO and index changes of a block already checked to connect in the batch
+func (chain *BlockChain) applyBlock(batch database.Batch, block *Block) error {
+	UTXOSet := UTXOSet{BlockChain: chain}
+	if err := UTXOSet.ConnectBlock(batch, block); err != nil {
+		return err
+	}
+
+	if err := indexHistory(batch, block); err != nil {
+		return err
+	}
+
+	return indexBlock(batch, block)
+}
+
+// Reverts the UTXO and index changes of the block in the batch
+func (chain *BlockChain) disconnectTip(batch database.Batch, block *Block) error {
+	if err := unindexHistory(batch, block); err != nil {
+		return err
+	}
+
+	UTXOSet := UTXOSet{BlockChain: chain}
+	if err := UTXOSet.DisconnectBlock(batch, block); err != nil {
+		return err
+	}
+
+	return unindexBlock(batch, block)
+}
+
+// Adds a block on top of the current tip. The block, its index entries, the UTXO changes
+// and the new tip are written in one batch, so a crash leaves either all or none of them
+func (chain *BlockChain) ConnectBlock(block *Block) error {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	return chain.connectBlock(block)
+}
+
+func (chain *BlockChain) connectBlock(block *Block) error {
+	if err := chain.finishReorganization(); err != nil {
+		return err
+	}
+
+	if bytes.Compare(block.PrevHash, chain.LastHash) != 0 {
+		return ErrNotTip
+	}
+
+	parentWork, err := chain.ChainWork(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	work := new(big.Int).Add(parentWork, block.Work())
+
+	batch := chain.Database.NewBatch()
+
+	if err := storeBlock(batch, block, work); err != nil {
+		return err
+	}
+
+	if err := chain.connectTip(batch, block); err != nil {
+		return err
+	}
+
+	if err := setTip(batch, block); err != nil {
+		return err
+	}
+
+	if err := batch.Write(); err != nil {
+		return err
+	}
+
+	chain.LastHash = block.Hash
+
+	return nil
+}
+
+// Repairs a chain whose indexes or UTXO set do not match the tip, as left by a crash in the middle
+// of an update, a reorganization or a rebuild, or by a database written before they existed
+func (chain *BlockChain) recover() {
+	if _, err := chain.Database.Read(reorgKey); err == nil {
+		fmt.Println("Reorganization was interrupted, finishing it")
+		err = chain.finishReorganization()
+		Handle(err)
+	}
+
+	tip, err := chain.GetBlock(chain.LastHash)
+	Handle(err)
+
+	indexed, err := chain.Database.Read(heightKey(tip.Height))
+	_, rebuilding := chain.Database.Read(blocksRebuildKey)
+	_, dataIndexed := chain.Database.Read(dataIndexFlagKey)
+	if err != nil || bytes.Compare(indexed, tip.Hash) != 0 || rebuilding == nil || dataIndexed != nil {
+		fmt.Println("Block indexes are out of date, rebuilding")
+		chain.ReindexBlocks()
+	}
+
+	// Before scripts, outputs were stored with the pubkey hash in place of the locking script
+	version, err := chain.Database.Read(stateVersionKey)
+	if err != nil || bytes.Compare(version, ToHex(ScriptTxVersion)) != 0 {
+		fmt.Println("UTXO set and undo data are in an old format, rebuilding")
+		chain.ReindexUndo()
+		UTXOSet := UTXOSet{BlockChain: chain}
+		UTXOSet.Reindex()
+	}
+
+	utxoTip, err := chain.Database.Read(utxoTipKey)
+	if err != nil || bytes.Compare(utxoTip, tip.Hash) != 0 {
+		fmt.Println("UTXO set is out of date, rebuilding")
+		UTXOSet := UTXOSet{BlockChain: chain}
+		UTXOSet.Reindex()
+	}
+}
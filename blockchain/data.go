@@ -0,0 +1,134 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"blockchain/main/script"
+	"sort"
+)
+
+var (
+	// Data of a main chain data output, its transaction ID and output index -> the output
+	// and where it is in the main chain
+	dataPrefix = []byte("data-")
+
+	// Records that the block indexes include the data index
+	dataIndexFlagKey = []byte("di")
+)
+
+// Data anchored on chain by a data output
+type DataRecord struct {
+	TxID      []byte
+	Out       int
+	BlockHash []byte
+	Height    int
+	Timestamp int64
+	Data      []byte
+}
+
+func dataKey(data, txID []byte, out int) []byte {
+	key := append(append(append([]byte{}, dataPrefix...), data...), txID...)
+
+	return append(key, ToHex(int64(out))...)
+}
+
+// Adds the data outputs of the block to the data index
+func indexData(batch database.Batch, block *Block) error {
+	for offset, tx := range block.Transactions {
+		for outIdx, out := range tx.Outputs {
+			data, ok := script.ExtractNullData(out.Script)
+			if ok == false {
+				continue
+			}
+
+			var e encoder
+			e.writeBytes(tx.ID)
+			e.writeInt64(int64(outIdx))
+			e.writeBytes(block.Hash)
+			e.writeInt64(int64(offset))
+			e.writeBytes(data)
+
+			if err := batch.Update(dataKey(data, tx.ID, outIdx), e.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Removes the data outputs of the block from the data index
+func unindexData(batch database.Batch, block *Block) error {
+	for _, tx := range block.Transactions {
+		for outIdx, out := range tx.Outputs {
+			data, ok := script.ExtractNullData(out.Script)
+			if ok == false {
+				continue
+			}
+
+			if err := batch.Delete(dataKey(data, tx.ID, outIdx)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the data outputs of the main chain whose data starts with the prefix, newest first.
+// An empty prefix matches every data output
+func (chain *BlockChain) FindData(prefix []byte) []DataRecord {
+	var records []DataRecord
+	var offsets []int
+
+	// Headers are shared by the outputs of a block
+	headers := make(map[string]BlockHeader)
+
+	err := chain.Database.Iterate(append(append([]byte{}, dataPrefix...), prefix...), func(_, val []byte) error {
+		d := &decoder{data: val}
+		record := DataRecord{TxID: d.readBytes(), Out: int(d.readInt64()), BlockHash: d.readBytes()}
+		offset := int(d.readInt64())
+		record.Data = d.readBytes()
+		if err := d.finish(); err != nil {
+			return err
+		}
+
+		header, ok := headers[string(record.BlockHash)]
+		if ok == false {
+			var err error
+			header, err = chain.GetBlockHeader(record.BlockHash)
+			if err != nil {
+				return err
+			}
+			headers[string(record.BlockHash)] = header
+		}
+		record.Height, record.Timestamp = header.Height, header.Timestamp
+
+		records = append(records, record)
+		offsets = append(offsets, offset)
+		return nil
+	})
+	Handle(err)
+
+	// The index is ordered by data, the records by their place in the chain
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if records[a].Height != records[b].Height {
+			return records[a].Height > records[b].Height
+		}
+		if offsets[a] != offsets[b] {
+			return offsets[a] < offsets[b]
+		}
+		return records[a].Out < records[b].Out
+	})
+
+	sorted := make([]DataRecord, len(records))
+	for i, index := range order {
+		sorted[i] = records[index]
+	}
+
+	return sorted
+}
@@ -0,0 +1,52 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDataIndexFollowsTheMainChain(t *testing.T) {
+	chain, w, _ := newTestChain(t)
+	UTXO := UTXOSet{chain}
+	address := string(w.Address())
+
+	first := NewDataTransaction(w, "", 0, []byte("doc:a"), 1, 0, &UTXO)
+	chain.MineBlock([]*Transaction{CoinbaseTx(address, "", chain.GetBestHeight()+1, 1), first})
+	fork := chain.Tip()
+
+	other := NewDataTransaction(w, "", 0, []byte("other"), 1, 0, &UTXO)
+	chain.MineBlock([]*Transaction{CoinbaseTx(address, "", chain.GetBestHeight()+1, 1), other})
+
+	second := NewDataTransaction(w, "", 0, []byte("doc:b"), 1, 0, &UTXO)
+	chain.MineBlock([]*Transaction{CoinbaseTx(address, "", chain.GetBestHeight()+1, 1), second})
+
+	records := chain.FindData([]byte("doc:"))
+	if len(records) != 2 || bytes.Equal(records[0].TxID, second.ID) == false || bytes.Equal(records[1].TxID, first.ID) == false {
+		t.Fatal("expected the data outputs newest first", records)
+	}
+	if records[0].Height != chain.GetBestHeight() || bytes.Equal(records[0].Data, []byte("doc:b")) == false {
+		t.Fatal("record does not describe the output", records[0])
+	}
+	if len(chain.FindData(nil)) != 3 {
+		t.Fatal("empty prefix does not match every data output")
+	}
+
+	// A heavier branch leaving the last two blocks out
+	parentHash := fork
+	for i := 0; i < 3; i++ {
+		parent, err := chain.GetBlockHeader(parentHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := newTestBlock(t, chain, parentHash, CoinbaseTx(address, "", parent.Height+1, 0))
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		parentHash = block.Hash
+	}
+
+	records = chain.FindData([]byte("doc:"))
+	if len(records) != 1 || bytes.Equal(records[0].TxID, first.ID) == false {
+		t.Fatal("disconnected data outputs are still found", records)
+	}
+}
@@ -0,0 +1,117 @@
+package blockchain
+
+import (
+	"math/big"
+)
+
+const (
+	// Number of blocks between difficulty adjustments
+	RetargetInterval = 10
+
+	// Desired time between blocks, in seconds
+	TargetBlockTime = 10
+
+	// Largest factor the difficulty can change by in one adjustment
+	maxRetargetFactor = 4
+)
+
+var (
+	// Easiest target a block may have
+	powLimit = new(big.Int).Lsh(big.NewInt(1), 256-8)
+
+	// Target of the genesis block, Difficulty leading zero bits
+	InitialBits = BigToCompact(new(big.Int).Lsh(big.NewInt(1), uint(256-Difficulty)))
+)
+
+// Decodes a target stored in the compact form used by the block Bits field.
+// The highest byte is the length of the number in bytes and the lower three bytes are its most significant digits
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	exponent := uint(compact >> 24)
+
+	// Negative targets are never valid
+	if compact&0x00800000 != 0 {
+		return big.NewInt(0)
+	}
+
+	if exponent <= 3 {
+		return big.NewInt(mantissa >> (8 * (3 - exponent)))
+	}
+
+	target := big.NewInt(mantissa)
+	return target.Lsh(target, 8*(exponent-3))
+}
+
+// Encodes a target in the compact form used by the block Bits field
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	exponent := uint(len(target.Bytes()))
+
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(target.Int64()) << (8 * (3 - exponent))
+	} else {
+		shifted := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = uint32(shifted.Int64())
+	}
+
+	// Keep the sign bit clear
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return uint32(exponent<<24) | mantissa
+}
+
+// Returns the header of the given height in the branch ending with the given header
+func (chain *BlockChain) Ancestor(header *BlockHeader, height int) (*BlockHeader, error) {
+	for header.Height > height {
+		parent, err := chain.GetBlockHeader(header.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		header = &parent
+	}
+
+	return header, nil
+}
+
+// Returns the target the child of the given block must commit to.
+// Every RetargetInterval blocks the target is scaled by how long the last interval took
+// compared to TargetBlockTime, limited to maxRetargetFactor in either direction
+func (chain *BlockChain) NextBits(parent *BlockHeader) (uint32, error) {
+	height := parent.Height + 1
+
+	if height%RetargetInterval != 0 {
+		return parent.Bits, nil
+	}
+
+	first, err := chain.Ancestor(parent, height-RetargetInterval)
+	if err != nil {
+		return 0, err
+	}
+
+	expected := int64((RetargetInterval - 1) * TargetBlockTime)
+	actual := parent.Timestamp - first.Timestamp
+
+	if actual < expected/maxRetargetFactor {
+		actual = expected / maxRetargetFactor
+	}
+	if actual > expected*maxRetargetFactor {
+		actual = expected * maxRetargetFactor
+	}
+
+	target := CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if target.Cmp(powLimit) > 0 {
+		target.Set(powLimit)
+	}
+
+	return BigToCompact(target), nil
+}
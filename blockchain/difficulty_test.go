@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"math/big"
+	"testing"
+)
+
+func TestCompactRoundTrips(t *testing.T) {
+	for _, compact := range []uint32{InitialBits, BigToCompact(powLimit), 0x1d00ffff, 0x03123456, 0x04123456, 0x01120000} {
+		if again := BigToCompact(CompactToBig(compact)); again != compact {
+			t.Fatalf("expected %08x, got %08x", compact, again)
+		}
+	}
+
+	for _, target := range []*big.Int{big.NewInt(1), big.NewInt(0x80), big.NewInt(0x123456), powLimit} {
+		if again := CompactToBig(BigToCompact(target)); again.Cmp(target) != 0 {
+			t.Fatalf("expected %x, got %x", target, again)
+		}
+	}
+
+	// A mantissa with its top bit set would read as negative, so it moves to the next byte
+	if compact := BigToCompact(big.NewInt(0x80)); compact&0x00800000 != 0 {
+		t.Fatalf("sign bit set in %08x", compact)
+	}
+	if CompactToBig(0x04923456).Sign() != 0 {
+		t.Fatal("negative target is not zero")
+	}
+}
+
+// Stores a branch of headers with the given bits and timestamps and returns the last of them
+func storeTestHeaders(t *testing.T, chain *BlockChain, bits uint32, timestamps []int64) *BlockHeader {
+	var prevHash []byte
+	var header BlockHeader
+	for height, timestamp := range timestamps {
+		header = BlockHeader{BlockVersion, prevHash, []byte{}, timestamp, bits, 0, height}
+		block := Block{header, header.Hash(), nil}
+
+		if err := chain.Database.Update(block.Hash, block.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+		prevHash = block.Hash
+	}
+
+	return &header
+}
+
+// Stores headers of the given bits spaced by the given number of seconds, up to the one
+// before a retarget, and returns the last of them
+func newRetargetChain(t *testing.T, bits uint32, spacing int64) (*BlockChain, *BlockHeader) {
+	chain := &BlockChain{Database: database.NewMemoryDatabase()}
+
+	var timestamps []int64
+	for height := 0; height < RetargetInterval; height++ {
+		timestamps = append(timestamps, 1000+int64(height)*spacing)
+	}
+
+	return chain, storeTestHeaders(t, chain, bits, timestamps)
+}
+
+func TestNextBitsIsClamped(t *testing.T) {
+	target := CompactToBig(InitialBits)
+
+	// Time the blocks of an interval are expected to take, and the target scaled by a time
+	expectedTime := int64((RetargetInterval - 1) * TargetBlockTime)
+	scaled := func(actual int64) *big.Int {
+		scaled := new(big.Int).Mul(target, big.NewInt(actual))
+		return scaled.Div(scaled, big.NewInt(expectedTime))
+	}
+
+	cases := []struct {
+		bits     uint32
+		spacing  int64
+		expected *big.Int
+	}{
+		{InitialBits, TargetBlockTime, target},
+		{InitialBits, 0, scaled(expectedTime / maxRetargetFactor)},
+		{InitialBits, 100 * TargetBlockTime, scaled(expectedTime * maxRetargetFactor)},
+		{BigToCompact(powLimit), 100 * TargetBlockTime, powLimit},
+	}
+
+	for _, c := range cases {
+		chain, parent := newRetargetChain(t, c.bits, c.spacing)
+
+		bits, err := chain.NextBits(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bits != BigToCompact(c.expected) {
+			t.Fatalf("spacing %d: expected %08x, got %08x", c.spacing, BigToCompact(c.expected), bits)
+		}
+
+		// Only the first block of an interval is retargeted
+		previous, err := chain.GetBlockHeader(parent.PrevHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bits, err := chain.NextBits(&previous); err != nil || bits != c.bits {
+			t.Fatalf("expected %08x, got %08x", c.bits, bits)
+		}
+	}
+}
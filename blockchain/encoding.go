@@ -0,0 +1,400 @@
+package blockchain
+
+// Binary encoding of the chain data, used for storage, for the network and for every hash.
+// Integers are big endian. Byte strings and lists are prefixed with their length as a uint32.
+// Fields are listed with the transaction version that introduced them.
+//
+// Transactions from ScriptTxVersion on:
+//
+//	Transaction: version uint32, input count uint32, inputs, output count uint32, outputs,
+//	             lock time uint32 (LockTimeVersion)
+//	Input:       previous transaction ID bytes, output index int64, unlocking script bytes,
+//	             sequence uint32 (LockTimeVersion)
+//	Output:      value int64, locking script bytes
+//
+// Version 1 transactions came before scripts and are decoded into pay-to-pubkey-hash scripts.
+// A version 1 coinbase keeps its data in the public key field:
+//
+//	Input:       previous transaction ID bytes, output index int64, signature bytes, public key bytes
+//	Output:      value int64, pubkey hash bytes
+//
+// Blocks and the chain state, the same for every version:
+//
+//	Header:       version uint32, previous hash bytes, merkle root bytes, timestamp int64, bits uint32,
+//	              nonce int64, height int64
+//	Block:        header, transaction count uint32, transactions as bytes
+//	UTXO entry:   output, height int64, coinbase flag byte
+//	Block undo:   spent output count uint32, spent outputs
+//	Spent output: transaction ID bytes, output index int64, UTXO entry
+//
+// Block versions change the rules blocks are checked by, not their encoding.
+//
+// The transaction ID is not encoded. It is the SHA-256 hash of the encoded transaction, with the
+// unlocking scripts left out from StableIDVersion on unless the transaction is a coinbase.
+// The block hash is not encoded either. It is the SHA-256 hash of the encoded header.
+
+import (
+	"blockchain/main/script"
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// Encoding versions written for new transactions and blocks
+	TxVersion    = 4
+	BlockVersion = 3
+
+	// First transaction version locking outputs with scripts
+	ScriptTxVersion = 2
+
+	// First transaction version with a lock time and input sequence numbers
+	LockTimeVersion = 3
+
+	// First transaction version whose ID does not cover the unlocking scripts
+	StableIDVersion = 4
+
+	// First block version hashing its Merkle tree with domain separation
+	TaggedMerkleVersion = 2
+
+	// First block version whose coinbase input script starts with the block height
+	CoinbaseHeightVersion = 3
+)
+
+var (
+	ErrMalformed      = errors.New("data is not a valid encoding")
+	ErrUnknownVersion = errors.New("encoding version is not supported")
+)
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) writeUint32(n uint32) {
+	var buff [4]byte
+	binary.BigEndian.PutUint32(buff[:], n)
+	e.Write(buff[:])
+}
+
+func (e *encoder) writeInt64(n int64) {
+	var buff [8]byte
+	binary.BigEndian.PutUint64(buff[:], uint64(n))
+	e.Write(buff[:])
+}
+
+func (e *encoder) writeBytes(data []byte) {
+	e.writeUint32(uint32(len(data)))
+	e.Write(data)
+}
+
+// Reads fields in order. After the first failure every read returns zero and err is set
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.data) {
+		d.err = ErrMalformed
+		return nil
+	}
+
+	field := d.data[:n]
+	d.data = d.data[n:]
+
+	return field
+}
+
+func (d *decoder) readUint32() uint32 {
+	field := d.next(4)
+	if field == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(field)
+}
+
+func (d *decoder) readInt64() int64 {
+	field := d.next(8)
+	if field == nil {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(field))
+}
+
+func (d *decoder) readBytes() []byte {
+	length := d.readUint32()
+	if uint64(length) > uint64(len(d.data)) {
+		d.err = ErrMalformed
+		return nil
+	}
+
+	return append([]byte{}, d.next(int(length))...)
+}
+
+// Reads a list length, rejecting lengths the remaining data cannot hold
+func (d *decoder) readCount(minSize int) int {
+	count := d.readUint32()
+	if uint64(count)*uint64(minSize) > uint64(len(d.data)) {
+		d.err = ErrMalformed
+		return 0
+	}
+
+	return int(count)
+}
+
+// Fails if anything is left after the last field
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.err = ErrMalformed
+	}
+
+	return d.err
+}
+
+func (in *TxInput) encode(e *encoder, version int) {
+	e.writeBytes(in.ID)
+	e.writeInt64(int64(in.Out))
+
+	if version < ScriptTxVersion {
+		sig, pubKey := legacyInputFields(in)
+		e.writeBytes(sig)
+		e.writeBytes(pubKey)
+		return
+	}
+
+	e.writeBytes(in.Script)
+
+	if version >= LockTimeVersion {
+		e.writeUint32(in.Sequence)
+	}
+}
+
+func decodeInput(d *decoder, version int) TxInput {
+	in := TxInput{
+		ID:       d.readBytes(),
+		Out:      int(d.readInt64()),
+		Sequence: script.MaxSequence,
+	}
+
+	if version < ScriptTxVersion {
+		sig := d.readBytes()
+		pubKey := d.readBytes()
+
+		if len(in.ID) == 0 && in.Out == -1 {
+			// Coinbases never had a signature, so there is nowhere to keep one
+			if len(sig) > 0 {
+				d.err = ErrMalformed
+			}
+			in.Script = pubKey
+		} else {
+			in.Script = script.PayToPubKeyHashUnlock(sig, pubKey)
+		}
+
+		return in
+	}
+
+	in.Script = d.readBytes()
+
+	if version >= LockTimeVersion {
+		in.Sequence = d.readUint32()
+	}
+
+	return in
+}
+
+func (out *TxOutput) encode(e *encoder) {
+	e.writeInt64(int64(out.Value))
+	e.writeBytes(out.Script)
+}
+
+func decodeOutput(d *decoder) TxOutput {
+	return TxOutput{
+		Value:  int(d.readInt64()),
+		Script: d.readBytes(),
+	}
+}
+
+// Returns the signature and the public key of a version 1 input, the data of a coinbase
+func legacyInputFields(in *TxInput) ([]byte, []byte) {
+	if len(in.ID) == 0 && in.Out == -1 {
+		return nil, in.Script
+	}
+
+	instructions, err := script.Parse(in.Script)
+	if err != nil || len(instructions) != 2 {
+		return nil, nil
+	}
+
+	return instructions[0].Data, instructions[1].Data
+}
+
+func encodeLegacyOutput(e *encoder, out *TxOutput) {
+	e.writeInt64(int64(out.Value))
+	e.writeBytes(script.ExtractPubKeyHash(out.Script))
+}
+
+func decodeLegacyOutput(d *decoder) TxOutput {
+	value := int(d.readInt64())
+	pubKeyHash := d.readBytes()
+
+	if d.err == nil && len(pubKeyHash) != 20 {
+		d.err = ErrMalformed
+	}
+
+	return TxOutput{value, script.PayToPubKeyHash(pubKeyHash)}
+}
+
+func (tx *Transaction) encode(e *encoder) {
+	e.writeUint32(uint32(tx.Version))
+
+	e.writeUint32(uint32(len(tx.Inputs)))
+	for i := range tx.Inputs {
+		tx.Inputs[i].encode(e, tx.Version)
+	}
+
+	e.writeUint32(uint32(len(tx.Outputs)))
+	for i := range tx.Outputs {
+		if tx.Version < ScriptTxVersion {
+			encodeLegacyOutput(e, &tx.Outputs[i])
+		} else {
+			tx.Outputs[i].encode(e)
+		}
+	}
+
+	if tx.Version >= LockTimeVersion {
+		e.writeUint32(tx.LockTime)
+	}
+}
+
+func decodeTransaction(d *decoder) Transaction {
+	tx := Transaction{Version: int(d.readUint32())}
+	if d.err == nil && (tx.Version < 1 || tx.Version > TxVersion) {
+		d.err = ErrUnknownVersion
+	}
+
+	// An input takes at least 16 bytes and an output at least 12
+	inputs := d.readCount(16)
+	for i := 0; i < inputs; i++ {
+		tx.Inputs = append(tx.Inputs, decodeInput(d, tx.Version))
+	}
+
+	outputs := d.readCount(12)
+	for i := 0; i < outputs; i++ {
+		if tx.Version < ScriptTxVersion {
+			tx.Outputs = append(tx.Outputs, decodeLegacyOutput(d))
+		} else {
+			tx.Outputs = append(tx.Outputs, decodeOutput(d))
+		}
+	}
+
+	if tx.Version >= LockTimeVersion {
+		tx.LockTime = d.readUint32()
+	}
+
+	if d.err == nil {
+		tx.ID = tx.Hash()
+	}
+
+	return tx
+}
+
+// Decodes a transaction and derives its ID
+func DecodeTransaction(data []byte) (Transaction, error) {
+	d := &decoder{data: data}
+	tx := decodeTransaction(d)
+
+	return tx, d.finish()
+}
+
+func (h *BlockHeader) encode(e *encoder) {
+	e.writeUint32(uint32(h.Version))
+	e.writeBytes(h.PrevHash)
+	e.writeBytes(h.MerkleRoot)
+	e.writeInt64(h.Timestamp)
+	e.writeUint32(h.Bits)
+	e.writeInt64(int64(h.Nonce))
+	e.writeInt64(int64(h.Height))
+}
+
+func decodeHeader(d *decoder) BlockHeader {
+	header := BlockHeader{Version: int(d.readUint32())}
+	if d.err == nil && (header.Version < 1 || header.Version > BlockVersion) {
+		d.err = ErrUnknownVersion
+	}
+
+	header.PrevHash = d.readBytes()
+	header.MerkleRoot = d.readBytes()
+	header.Timestamp = d.readInt64()
+	header.Bits = d.readUint32()
+	header.Nonce = int(d.readInt64())
+	header.Height = int(d.readInt64())
+
+	return header
+}
+
+func DecodeHeader(data []byte) (*BlockHeader, error) {
+	d := &decoder{data: data}
+	header := decodeHeader(d)
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return &header, nil
+}
+
+func (b *Block) encode(e *encoder) {
+	b.BlockHeader.encode(e)
+
+	e.writeUint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.writeBytes(tx.Serialize())
+	}
+}
+
+// Decodes a block and derives its hash from the header
+func DecodeBlock(data []byte) (*Block, error) {
+	d := &decoder{data: data}
+	block := &Block{BlockHeader: decodeHeader(d)}
+
+	count := d.readCount(4)
+	for i := 0; i < count; i++ {
+		tx, err := DecodeTransaction(d.readBytes())
+		if d.err != nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		block.Transactions = append(block.Transactions, &tx)
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	block.Hash = block.BlockHeader.Hash()
+
+	return block, nil
+}
+
+func (entry *UTXOEntry) encode(e *encoder) {
+	entry.Output.encode(e)
+	e.writeInt64(int64(entry.Height))
+	if entry.Coinbase {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+}
+
+func decodeEntry(d *decoder) UTXOEntry {
+	entry := UTXOEntry{Output: decodeOutput(d)}
+	entry.Height = int(d.readInt64())
+
+	flag := d.next(1)
+	entry.Coinbase = flag != nil && flag[0] == 1
+
+	return entry
+}
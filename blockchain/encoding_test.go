@@ -0,0 +1,207 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"blockchain/main/script"
+	"blockchain/main/wallet"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// Fields of a transaction in the version 1 encoding
+type legacyInput struct {
+	id     []byte
+	out    int
+	sig    []byte
+	pubKey []byte
+}
+
+type legacyOutput struct {
+	value      int
+	pubKeyHash []byte
+}
+
+func encodeLegacy(inputs []legacyInput, outputs []legacyOutput) []byte {
+	var e encoder
+	e.writeUint32(1)
+
+	e.writeUint32(uint32(len(inputs)))
+	for _, in := range inputs {
+		e.writeBytes(in.id)
+		e.writeInt64(int64(in.out))
+		e.writeBytes(in.sig)
+		e.writeBytes(in.pubKey)
+	}
+
+	e.writeUint32(uint32(len(outputs)))
+	for _, out := range outputs {
+		e.writeInt64(int64(out.value))
+		e.writeBytes(out.pubKeyHash)
+	}
+
+	return e.Bytes()
+}
+
+func decodeLegacy(t *testing.T, data []byte) *Transaction {
+	tx, err := DecodeTransaction(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(tx.Serialize(), data) == false {
+		t.Fatal("version 1 transaction does not encode back to its bytes")
+	}
+
+	return &tx
+}
+
+// Signs the inputs the way version 1 did, over the transaction with every signature and public key
+// left out and the pubkey hash of the spent output in place of the public key of the input
+func signLegacy(w *wallet.Wallet, inputs []legacyInput, outputs []legacyOutput) {
+	for i := range inputs {
+		var txCopy []legacyInput
+		for j, in := range inputs {
+			txCopy = append(txCopy, legacyInput{in.id, in.out, nil, nil})
+			if j == i {
+				txCopy[j].pubKey = wallet.PublicKeyHash(w.PublicKey)
+			}
+		}
+
+		hash := sha256.Sum256(encodeLegacy(txCopy, outputs))
+		r, s, err := ecdsa.Sign(rand.Reader, &w.PrivateKey, hash[:])
+		Handle(err)
+
+		inputs[i].sig = append(r.Bytes(), s.Bytes()...)
+		inputs[i].pubKey = w.PublicKey
+	}
+}
+
+func TestLegacyTransactionDecodes(t *testing.T) {
+	w := wallet.MakeWallet()
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+
+	coinbase := decodeLegacy(t, encodeLegacy(
+		[]legacyInput{{[]byte{}, -1, nil, []byte("legacy coinbase")}},
+		[]legacyOutput{{20, pubKeyHash}}))
+
+	if coinbase.IsCoinbase() == false || bytes.Equal(coinbase.Inputs[0].Script, []byte("legacy coinbase")) == false {
+		t.Fatal("coinbase data is not kept")
+	}
+	if bytes.Equal(coinbase.Outputs[0].AddressHash(), pubKeyHash) == false {
+		t.Fatal("output is not locked to the pubkey hash")
+	}
+
+	inputs := []legacyInput{{coinbase.ID, 0, nil, nil}}
+	outputs := []legacyOutput{{20, pubKeyHash}}
+	signLegacy(w, inputs, outputs)
+
+	spend := decodeLegacy(t, encodeLegacy(inputs, outputs))
+
+	// Version 1 IDs hash the transaction without its signatures
+	unsigned := []legacyInput{{coinbase.ID, 0, nil, w.PublicKey}}
+	ID := sha256.Sum256(encodeLegacy(unsigned, outputs))
+	if bytes.Equal(spend.ID, ID[:]) == false {
+		t.Fatal("version 1 ID is not derived the way it was")
+	}
+
+	prevTXs := map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase}
+
+	if err := spend.Verify(prevTXs, 1, 0); err != nil {
+		t.Fatal("version 1 signature does not verify:", err)
+	}
+
+	spend.Inputs[0].Script = script.PayToPubKeyHashUnlock(inputs[0].sig, wallet.MakeWallet().PublicKey)
+	if spend.Verify(prevTXs, 1, 0) == nil {
+		t.Fatal("version 1 input unlocked with another key")
+	}
+}
+
+func TestLegacyChainLoads(t *testing.T) {
+	w := wallet.MakeWallet()
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+
+	db := database.NewMemoryDatabase()
+	chain := NewBlockChain(db, string(w.Address()))
+
+	// Blocks paying version 1 coinbases, the first spent by a version 1 transaction once mature.
+	// The coinbase data starts with the height the current block version commits to
+	var coinbases []*Transaction
+	for i := 0; i <= CoinbaseMaturity; i++ {
+		data := script.NewBuilder().AddInt(int64(chain.GetBestHeight() + 1)).Script()
+		coinbase := decodeLegacy(t, encodeLegacy(
+			[]legacyInput{{[]byte{}, -1, nil, data}},
+			[]legacyOutput{{Subsidy(chain.GetBestHeight() + 1), pubKeyHash}}))
+		coinbases = append(coinbases, coinbase)
+		chain.MineBlock([]*Transaction{coinbase})
+	}
+
+	inputs := []legacyInput{{coinbases[0].ID, 0, nil, nil}}
+	outputs := []legacyOutput{{5, pubKeyHash}, {15, pubKeyHash}}
+	signLegacy(w, inputs, outputs)
+	spend := decodeLegacy(t, encodeLegacy(inputs, outputs))
+
+	data := script.NewBuilder().AddInt(int64(chain.GetBestHeight() + 1)).AddData([]byte("spend")).Script()
+	coinbase := decodeLegacy(t, encodeLegacy(
+		[]legacyInput{{[]byte{}, -1, nil, data}},
+		[]legacyOutput{{Subsidy(chain.GetBestHeight() + 1), pubKeyHash}}))
+	block := newTestBlock(t, chain, chain.LastHash, coinbase, spend)
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	UTXO := UTXOSet{chain}
+	balance := 0
+	for _, out := range UTXO.FindUnspentTransactions(pubKeyHash) {
+		balance += out.Value
+	}
+
+	// Store the outputs of the UTXO set and of the undo data the way version 1 did
+	batch := db.NewBatch()
+	for _, prefix := range [][]byte{utxoPrefix, undoPrefix} {
+		err := db.Iterate(prefix, func(key, val []byte) error {
+			if bytes.HasPrefix(key, undoPrefix) {
+				undo := DeserializeUndo(val)
+				for i := range undo.Spent {
+					undo.Spent[i].Output.Script = script.ExtractPubKeyHash(undo.Spent[i].Output.Script)
+				}
+				return batch.Update(key, undo.Serialize())
+			}
+
+			entry := DeserializeEntry(val)
+			entry.Output.Script = entry.Output.AddressHash()
+			return batch.Update(key, entry.Serialize())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Delete(stateVersionKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	chain = LoadBlockChain(db)
+	UTXO = UTXOSet{chain}
+
+	reloaded := 0
+	for _, out := range UTXO.FindUnspentTransactions(pubKeyHash) {
+		reloaded += out.Value
+	}
+	if reloaded != balance {
+		t.Fatal("balance changed after rebuilding the old UTXO set", balance, reloaded)
+	}
+
+	undoData, err := db.Read(undoKey(block.Hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	undo := DeserializeUndo(undoData)
+	if len(undo.Spent) != 1 || bytes.Equal(undo.Spent[0].Output.AddressHash(), pubKeyHash) == false {
+		t.Fatal("undo data is not rebuilt with locking scripts")
+	}
+}
@@ -0,0 +1,225 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+type Direction byte
+
+const (
+	Received Direction = iota
+	Sent
+)
+
+var (
+	// Pubkey hash, height, transaction ID and direction -> amount
+	historyPrefix = []byte("hist-")
+
+	// Set once the address history index has been built
+	historyFlagKey = []byte("hi")
+
+	ErrNoAddressHistory = errors.New("address history index is not enabled")
+)
+
+// Transaction that paid to or spent from an address
+type HistoryEntry struct {
+	TxID      []byte
+	Height    int
+	Direction Direction
+	Amount    int
+}
+
+func (d Direction) String() string {
+	if d == Sent {
+		return "sent"
+	}
+
+	return "received"
+}
+
+// Prefix of the history keys of the pubkey hash, length prefixed like the address UTXO index
+func historyKeyPrefix(pubKeyHash []byte) []byte {
+	prefix := append(append([]byte{}, historyPrefix...), byte(len(pubKeyHash)))
+
+	return append(prefix, pubKeyHash...)
+}
+
+// Keys sort by height so the history is listed in chain order
+func historyKey(pubKeyHash []byte, entry HistoryEntry) []byte {
+	key := append(historyKeyPrefix(pubKeyHash), ToHex(int64(entry.Height))...)
+	key = append(key, entry.TxID...)
+
+	return append(key, byte(entry.Direction))
+}
+
+// Returns the amounts each transaction of the block moved per address, keyed by history key.
+// The block undo data provides the values of the spent outputs
+func blockHistory(block *Block, undo BlockUndo) map[string]int {
+	amounts := make(map[string]int)
+	spent := undo.Spent
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for range tx.Inputs {
+				out := spent[0].Output
+				spent = spent[1:]
+
+				if out.AddressHash() == nil {
+					continue
+				}
+
+				key := historyKey(out.AddressHash(), HistoryEntry{tx.ID, block.Height, Sent, 0})
+				amounts[string(key)] += out.Value
+			}
+		}
+
+		for _, out := range tx.Outputs {
+			// Only outputs paying to an address have a history
+			if out.AddressHash() == nil {
+				continue
+			}
+
+			key := historyKey(out.AddressHash(), HistoryEntry{tx.ID, block.Height, Received, 0})
+			amounts[string(key)] += out.Value
+		}
+	}
+
+	return amounts
+}
+
+// Adds the block to the address history if the index is enabled. Must run after the UTXO set is updated
+func indexHistory(batch database.Batch, block *Block) error {
+	if _, err := batch.Read(historyFlagKey); err == database.ErrNotFound {
+		return nil
+	}
+
+	return putHistory(batch, block)
+}
+
+// Adds the history entries of the block to the batch
+func putHistory(batch database.Batch, block *Block) error {
+	data, err := batch.Read(undoKey(block.Hash))
+	if err != nil {
+		return err
+	}
+
+	for key, amount := range blockHistory(block, DeserializeUndo(data)) {
+		if err := batch.Update([]byte(key), ToHex(int64(amount))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes the block from the address history. Must run before the block undo data is deleted
+func unindexHistory(batch database.Batch, block *Block) error {
+	if _, err := batch.Read(historyFlagKey); err == database.ErrNotFound {
+		return nil
+	}
+
+	data, err := batch.Read(undoKey(block.Hash))
+	if err != nil {
+		return err
+	}
+
+	for key := range blockHistory(block, DeserializeUndo(data)) {
+		if err := batch.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Builds the address history of the main chain and keeps it updated from now on.
+// The index is only enabled once it is complete, and an interrupted build continues where it stopped
+func (chain *BlockChain) EnableAddressHistory() {
+	height := 0
+
+	if last := chain.resumeRebuild(historyRebuildKey); last != nil {
+		block, err := chain.GetBlockHeader(last)
+		Handle(err)
+		height = block.Height + 1
+	} else {
+		err := chain.Database.Delete(historyFlagKey)
+		Handle(err)
+
+		deleteByPrefix(chain.Database, historyPrefix)
+	}
+
+	tip, err := chain.GetBlockHeader(chain.LastHash)
+	Handle(err)
+
+	batch := newChunkedBatch(chain.Database)
+
+	for ; height <= tip.Height; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		Handle(err)
+
+		err = putHistory(batch, &block)
+		Handle(err)
+
+		err = chain.saveRebuild(batch, historyRebuildKey, block.Hash)
+		Handle(err)
+
+		err = batch.checkpoint()
+		Handle(err)
+	}
+
+	err = batch.Update(historyFlagKey, []byte{1})
+	Handle(err)
+
+	err = batch.Delete(historyRebuildKey)
+	Handle(err)
+
+	err = batch.Write()
+	Handle(err)
+}
+
+func (chain *BlockChain) HasAddressHistory() bool {
+	_, err := chain.Database.Read(historyFlagKey)
+
+	return err == nil
+}
+
+// Returns up to limit history entries of the pubkey hash in chain order, skipping the first offset entries
+func (chain *BlockChain) GetHistory(pubKeyHash []byte, offset, limit int) ([]HistoryEntry, error) {
+	if chain.HasAddressHistory() == false {
+		return nil, ErrNoAddressHistory
+	}
+
+	var entries []HistoryEntry
+	prefix := historyKeyPrefix(pubKeyHash)
+	skipped := 0
+
+	errDone := errors.New("page is full")
+
+	err := chain.Database.Iterate(prefix, func(key, value []byte) error {
+		if skipped < offset {
+			skipped++
+			return nil
+		}
+		if len(entries) >= limit {
+			return errDone
+		}
+
+		key = bytes.TrimPrefix(key, prefix)
+		entries = append(entries, HistoryEntry{
+			TxID:      key[8 : len(key)-1],
+			Height:    int(binary.BigEndian.Uint64(key[:8])),
+			Direction: Direction(key[len(key)-1]),
+			Amount:    int(binary.BigEndian.Uint64(value)),
+		})
+
+		return nil
+	})
+	if err != nil && err != errDone {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,62 @@
+package blockchain
+
+import (
+	"blockchain/main/wallet"
+	"bytes"
+	"testing"
+)
+
+func TestHistoryPagesAndDirections(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	to := wallet.MakeWallet()
+
+	if _, err := chain.GetHistory(pubKeyHash, 0, 10); err != ErrNoAddressHistory {
+		t.Fatalf("expected %v, got %v", ErrNoAddressHistory, err)
+	}
+
+	chain.EnableAddressHistory()
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(20, string(to.Address())))
+	miner := string(wallet.MakeWallet().Address())
+	chain.MineBlock([]*Transaction{CoinbaseTx(miner, "", chain.GetBestHeight()+1, 0), tx})
+	height := chain.GetBestHeight()
+
+	// A coinbase received at every height before the spend, then the spend
+	all, err := chain.GetHistory(pubKeyHash, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != height+1 {
+		t.Fatalf("expected %d entries, got %d", height+1, len(all))
+	}
+	for i, entry := range all[:height] {
+		if entry.Height != i || entry.Direction != Received || entry.Amount != Subsidy(i) {
+			t.Fatal("unexpected entry", i, entry)
+		}
+	}
+	sent := all[height]
+	if bytes.Equal(sent.TxID, tx.ID) == false || sent.Height != height || sent.Direction != Sent || sent.Amount != 20 {
+		t.Fatal("spend is not listed as sent", sent)
+	}
+
+	page, err := chain.GetHistory(pubKeyHash, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 3 || page[0].Height != 2 || page[2].Height != 4 {
+		t.Fatal("offset and limit do not select the page", page)
+	}
+
+	if page, err := chain.GetHistory(pubKeyHash, len(all)-1, 3); err != nil || len(page) != 1 || page[0].Direction != Sent {
+		t.Fatal("last page is not cut at the end of the history", page, err)
+	}
+
+	received, err := chain.GetHistory(wallet.PublicKeyHash(to.PublicKey), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].Direction != Received || received[0].Amount != 20 {
+		t.Fatal("payment is not listed as received", received)
+	}
+}
@@ -0,0 +1,127 @@
+package blockchain
+
+import (
+	"blockchain/main/script"
+	"blockchain/main/wallet"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var (
+	ErrNotHTLC        = errors.New("output is not a hash time-locked contract")
+	ErrWrongSecret    = errors.New("secret does not hash to the contract secret hash")
+	ErrNotParty       = errors.New("wallet key is not the one the contract pays to")
+	ErrSecretNotFound = errors.New("contract has not been redeemed on the main chain")
+)
+
+// Creates a transaction locking amount in a hash time-locked contract. The recipient can redeem
+// it with the secret hashing to secretHash, and the wallet can refund it from the lock time on
+func NewHTLCTransaction(w *wallet.Wallet, recipient string, amount, fee int, secretHash []byte, lockTime int64, UTXO *UTXOSet) *Transaction {
+	recipientHash, isScript := wallet.DecodeAddress([]byte(recipient))
+	if isScript {
+		log.Panic("Error: contract recipient must be a wallet address")
+	}
+
+	contract := script.HTLC(secretHash, recipientHash, lockTime, wallet.PublicKeyHash(w.PublicKey))
+
+	return newTransaction(w, []TxOutput{{amount, contract}}, fee, 0, UTXO)
+}
+
+// Creates a transaction spending the contract output to the wallet. With a secret the wallet
+// redeems the contract as its recipient, without one it takes a refund from the lock time on
+func NewHTLCSpend(w *wallet.Wallet, contractTx *Transaction, out int, secret []byte, fee int) (*Transaction, error) {
+	if out < 0 || out >= len(contractTx.Outputs) {
+		return nil, ErrMissingInput
+	}
+
+	contract := contractTx.Outputs[out]
+	secretHash, recipientHash, lockTime, refundHash, ok := script.ExtractHTLC(contract.Script)
+	if ok == false {
+		return nil, ErrNotHTLC
+	}
+
+	if contract.Value < fee {
+		return nil, ErrBadValue
+	}
+
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	var txLockTime uint32
+
+	if secret != nil {
+		hash := sha256.Sum256(secret)
+		if bytes.Equal(hash[:], secretHash) == false || len(secret) != script.HTLCSecretSize {
+			return nil, ErrWrongSecret
+		}
+		if bytes.Equal(pubKeyHash, recipientHash) == false {
+			return nil, ErrNotParty
+		}
+	} else {
+		if bytes.Equal(pubKeyHash, refundHash) == false {
+			return nil, ErrNotParty
+		}
+		// Nodes keep the refund out of blocks until the contract lock time
+		txLockTime = uint32(lockTime)
+	}
+
+	to := fmt.Sprintf("%s", w.Address())
+	input := TxInput{contractTx.ID, out, nil, inputSequence(txLockTime)}
+	tx := Transaction{nil, TxVersion, []TxInput{input}, []TxOutput{*NewTXOutput(contract.Value-fee, to)}, txLockTime}
+
+	sig := wallet.Sign(w.PrivateKey, tx.SignatureHash(0, contract.Script))
+	if secret != nil {
+		tx.Inputs[0].Script = script.HTLCRedeem(sig, w.PublicKey, secret)
+	} else {
+		tx.Inputs[0].Script = script.HTLCRefund(sig, w.PublicKey)
+	}
+	tx.ID = tx.Hash()
+
+	return &tx, nil
+}
+
+// Returns the secret the recipient revealed by redeeming the contract output. The main chain
+// is searched from its tip back to the block of the contract, which can hold the redeem too
+func (chain *BlockChain) FindHTLCSecret(txID []byte, out int) ([]byte, error) {
+	contractTx, contractBlock, err := chain.lookupTransaction(chain.Database, txID)
+	if err != nil {
+		return nil, err
+	}
+
+	if out < 0 || out >= len(contractTx.Outputs) {
+		return nil, ErrMissingInput
+	}
+
+	secretHash, _, _, _, ok := script.ExtractHTLC(contractTx.Outputs[out].Script)
+	if ok == false {
+		return nil, ErrNotHTLC
+	}
+
+	iter := chain.Iterator()
+
+	for {
+		block := iter.Next()
+
+		for _, tx := range block.Transactions {
+			for _, in := range tx.Inputs {
+				if bytes.Equal(in.ID, txID) == false || in.Out != out {
+					continue
+				}
+
+				secret := script.ExtractHTLCSecret(in.Script)
+				hash := sha256.Sum256(secret)
+				if secret == nil || bytes.Equal(hash[:], secretHash) == false {
+					// Spent by a refund
+					return nil, ErrSecretNotFound
+				}
+
+				return secret, nil
+			}
+		}
+
+		if bytes.Equal(block.Hash, contractBlock.Hash) || len(block.PrevHash) == 0 {
+			return nil, ErrSecretNotFound
+		}
+	}
+}
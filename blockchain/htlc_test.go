@@ -0,0 +1,86 @@
+package blockchain
+
+import (
+	"blockchain/main/wallet"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func newTestSecret() ([]byte, []byte) {
+	secret := bytes.Repeat([]byte{7}, 32)
+	hash := sha256.Sum256(secret)
+
+	return secret, hash[:]
+}
+
+func TestHTLCSecretIsFound(t *testing.T) {
+	chain, alice, _ := newTestChain(t)
+	bob := wallet.MakeWallet()
+	UTXO := UTXOSet{chain}
+	secret, secretHash := newTestSecret()
+
+	contract := NewHTLCTransaction(alice, string(bob.Address()), 10, 1, secretHash, int64(chain.GetBestHeight()+20), &UTXO)
+	mineTestBlocks(chain, alice, 1)
+	coinbase := CoinbaseTx(string(alice.Address()), "", chain.GetBestHeight()+1, 1)
+	chain.MineBlock([]*Transaction{coinbase, contract})
+
+	if _, err := chain.FindHTLCSecret(contract.ID, 0); errors.Is(err, ErrSecretNotFound) == false {
+		t.Fatalf("expected %v before the redeem, got %v", ErrSecretNotFound, err)
+	}
+
+	if _, err := NewHTLCSpend(bob, contract, 0, make([]byte, 32), 1); errors.Is(err, ErrWrongSecret) == false {
+		t.Fatalf("expected %v, got %v", ErrWrongSecret, err)
+	}
+	if _, err := NewHTLCSpend(alice, contract, 0, secret, 1); errors.Is(err, ErrNotParty) == false {
+		t.Fatalf("expected %v, got %v", ErrNotParty, err)
+	}
+
+	// The lock time keeps the refund out of the next blocks
+	refund, err := NewHTLCSpend(alice, contract, 0, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.CheckLocks(refund); errors.Is(err, ErrNotFinal) == false {
+		t.Fatalf("expected %v, got %v", ErrNotFinal, err)
+	}
+
+	redeem, err := NewHTLCSpend(bob, contract, 0, secret, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase = CoinbaseTx(string(alice.Address()), "", chain.GetBestHeight()+1, 1)
+	chain.MineBlock([]*Transaction{coinbase, redeem})
+	mineTestBlocks(chain, alice, 2)
+
+	found, err := chain.FindHTLCSecret(contract.ID, 0)
+	if err != nil || bytes.Equal(found, secret) == false {
+		t.Fatal("secret not found", err)
+	}
+}
+
+func TestHTLCSecretIsFoundInContractBlock(t *testing.T) {
+	chain, alice, _ := newTestChain(t)
+	bob := wallet.MakeWallet()
+	UTXO := UTXOSet{chain}
+	secret, secretHash := newTestSecret()
+
+	contract := NewHTLCTransaction(alice, string(bob.Address()), 10, 1, secretHash, int64(chain.GetBestHeight()+20), &UTXO)
+	redeem, err := NewHTLCSpend(bob, contract, 0, secret, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The redeem comes after the contract in the block that mines both
+	coinbase := CoinbaseTx(string(alice.Address()), "", chain.GetBestHeight()+1, 2)
+	block := newTestBlock(t, chain, chain.Tip(), coinbase, contract, redeem)
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := chain.FindHTLCSecret(contract.ID, 0)
+	if err != nil || bytes.Equal(found, secret) == false {
+		t.Fatal("secret in the contract block not found", err)
+	}
+}
@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// Height of a main chain block -> block hash
+	heightPrefix = []byte("height-")
+
+	// Transaction ID -> hash of the main chain block containing it and its position in the block
+	txIndexPrefix = []byte("tx-")
+
+	ErrTxNotFound = errors.New("transaction does not exist")
+)
+
+// Anything keys can be read from, a database or a batch seeing its own pending changes
+type reader interface {
+	Read(key []byte) ([]byte, error)
+}
+
+func heightKey(height int) []byte {
+	return append(append([]byte{}, heightPrefix...), ToHex(int64(height))...)
+}
+
+func txIndexKey(ID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), ID...)
+}
+
+// Adds the block, its transactions and its data outputs to the main chain indexes
+func indexBlock(batch database.Batch, block *Block) error {
+	if err := batch.Update(heightKey(block.Height), block.Hash); err != nil {
+		return err
+	}
+
+	for offset, tx := range block.Transactions {
+		value := append(append([]byte{}, block.Hash...), ToHex(int64(offset))...)
+		if err := batch.Update(txIndexKey(tx.ID), value); err != nil {
+			return err
+		}
+	}
+
+	return indexData(batch, block)
+}
+
+// Removes the block, its transactions and its data outputs from the main chain indexes
+func unindexBlock(batch database.Batch, block *Block) error {
+	if err := batch.Delete(heightKey(block.Height)); err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		if err := batch.Delete(txIndexKey(tx.ID)); err != nil {
+			return err
+		}
+	}
+
+	return unindexData(batch, block)
+}
+
+// Finds a main chain transaction and the block containing it through the transaction index
+func (chain *BlockChain) lookupTransaction(r reader, ID []byte) (Transaction, *Block, error) {
+	value, err := r.Read(txIndexKey(ID))
+	if err == database.ErrNotFound {
+		return Transaction{}, nil, ErrTxNotFound
+	}
+	if err != nil {
+		return Transaction{}, nil, err
+	}
+
+	blockHash := value[:len(value)-8]
+	offset := int(binary.BigEndian.Uint64(value[len(value)-8:]))
+
+	block, err := chain.GetBlock(blockHash)
+	if err != nil {
+		return Transaction{}, nil, err
+	}
+
+	if offset >= len(block.Transactions) || bytes.Compare(block.Transactions[offset].ID, ID) != 0 {
+		return Transaction{}, nil, ErrTxNotFound
+	}
+
+	return *block.Transactions[offset], &block, nil
+}
+
+// Proof that a transaction is included in a block, checkable with the block header alone
+type TxProof struct {
+	Header      BlockHeader
+	Transaction []byte
+	Index       int
+	Path        []MerkleProofStep
+}
+
+// Builds the inclusion proof of a main chain transaction
+func (chain *BlockChain) TransactionProof(ID []byte) (*TxProof, error) {
+	tx, block, err := chain.lookupTransaction(chain.Database, ID)
+	if err != nil {
+		return nil, err
+	}
+
+	index := 0
+	for i, blockTx := range block.Transactions {
+		if bytes.Compare(blockTx.ID, tx.ID) == 0 {
+			index = i
+		}
+	}
+
+	path, err := block.MerkleTree().Proof(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TxProof{block.BlockHeader, tx.Serialize(), index, path}, nil
+}
+
+// Reports whether the header has valid proof of work and commits to the transaction
+func (proof *TxProof) Verify() bool {
+	if CheckHeader(&proof.Header) != nil {
+		return false
+	}
+
+	legacy := proof.Header.Version < TaggedMerkleVersion
+
+	return verifyMerkleProof(proof.Transaction, proof.Path, proof.Header.MerkleRoot, legacy)
+}
+
+// Returns the main chain block of the given height
+func (chain *BlockChain) GetBlockByHeight(height int) (Block, error) {
+	blockHash, err := chain.Database.Read(heightKey(height))
+	if err != nil {
+		return Block{}, err
+	}
+
+	return chain.GetBlock(blockHash)
+}
+
+// Rebuilds the height, transaction and data indexes by walking the main chain
+func (chain *BlockChain) ReindexBlocks() {
+	next := chain.resumeRebuild(blocksRebuildKey)
+	if next == nil {
+		deleteByPrefix(chain.Database, heightPrefix)
+		deleteByPrefix(chain.Database, txIndexPrefix)
+		deleteByPrefix(chain.Database, dataPrefix)
+		next = chain.LastHash
+	}
+
+	batch := newChunkedBatch(chain.Database)
+	iter := &ChainIterator{next, chain.Database}
+
+	for {
+		block := iter.Next()
+
+		err := indexBlock(batch, block)
+		Handle(err)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+
+		err = chain.saveRebuild(batch, blocksRebuildKey, block.PrevHash)
+		Handle(err)
+
+		err = batch.checkpoint()
+		Handle(err)
+	}
+
+	err := batch.Delete(blocksRebuildKey)
+	Handle(err)
+
+	err = batch.Update(dataIndexFlagKey, []byte{})
+	Handle(err)
+
+	err = batch.Write()
+	Handle(err)
+}
@@ -0,0 +1,153 @@
+package blockchain
+
+import "blockchain/main/script"
+
+// Returns the sequence of a new input. A lock time only applies when some input is not final
+func inputSequence(lockTime uint32) uint32 {
+	if lockTime == 0 {
+		return script.MaxSequence
+	}
+
+	return script.MaxSequence - 1
+}
+
+// Returns the sequence of an input that can be spent once its output is the number of blocks old
+func SequenceFromBlocks(blocks uint16) uint32 {
+	return uint32(blocks)
+}
+
+// Returns the sequence of an input that can be spent once its output is the number of seconds old,
+// rounded up to units of 512 seconds
+func SequenceFromSeconds(seconds uint32) uint32 {
+	units := (seconds + 1<<script.SequenceGranularity - 1) >> script.SequenceGranularity
+	if units > script.SequenceMask {
+		units = script.SequenceMask
+	}
+
+	return script.SequenceTypeFlag | units
+}
+
+// Reports whether the transaction can be mined in a block of the given height whose parent
+// has the given median time past. The lock time is ignored when every input is final
+func (tx *Transaction) IsFinal(height int, medianTime int64) bool {
+	if tx.Version < LockTimeVersion || tx.LockTime == 0 {
+		return true
+	}
+
+	if tx.LockTime < script.LockTimeThreshold {
+		if int64(height) >= int64(tx.LockTime) {
+			return true
+		}
+	} else if medianTime >= int64(tx.LockTime) {
+		return true
+	}
+
+	for _, in := range tx.Inputs {
+		if in.Sequence != script.MaxSequence {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reports whether the relative lock times of the inputs have passed in the child of the parent.
+// coinHeights holds the height of the block that created the output each input spends.
+// Time based locks count from the median time past of the parent of that block
+func (chain *BlockChain) checkSequenceLocks(tx *Transaction, coinHeights []int, parent *BlockHeader) (bool, error) {
+	if tx.Version < LockTimeVersion || tx.IsCoinbase() {
+		return true, nil
+	}
+
+	var medianTime int64
+	timeLocked := false
+
+	for i, in := range tx.Inputs {
+		if in.Sequence&script.SequenceDisableFlag != 0 {
+			continue
+		}
+
+		value := int64(in.Sequence & script.SequenceMask)
+
+		if in.Sequence&script.SequenceTypeFlag == 0 {
+			if parent.Height+1 < coinHeights[i]+int(value) {
+				return false, nil
+			}
+			continue
+		}
+
+		if timeLocked == false {
+			var err error
+			medianTime, err = chain.MedianTimePast(parent)
+			if err != nil {
+				return false, err
+			}
+			timeLocked = true
+		}
+
+		coinHeight := coinHeights[i] - 1
+		if coinHeight < 0 {
+			coinHeight = 0
+		}
+
+		coinParent, err := chain.Ancestor(parent, coinHeight)
+		if err != nil {
+			return false, err
+		}
+
+		coinTime, err := chain.MedianTimePast(coinParent)
+		if err != nil {
+			return false, err
+		}
+
+		if medianTime < coinTime+value<<script.SequenceGranularity {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Checks the lock time and the relative lock times of the transaction for the next block.
+// Returns ErrNotFinal or ErrSequenceLocked while it cannot be mined yet
+func (chain *BlockChain) CheckLocks(tx *Transaction) error {
+	tip, err := chain.GetBlockHeader(chain.Tip())
+	if err != nil {
+		return err
+	}
+
+	medianTime, err := chain.MedianTimePast(&tip)
+	if err != nil {
+		return err
+	}
+
+	if tx.IsFinal(tip.Height+1, medianTime) == false {
+		return ErrNotFinal
+	}
+
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	var coinHeights []int
+	for _, in := range tx.Inputs {
+		entry, err := findUnspent(chain.Database, in.ID, in.Out)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return ErrMissingInput
+		}
+		coinHeights = append(coinHeights, entry.Height)
+	}
+
+	unlocked, err := chain.checkSequenceLocks(tx, coinHeights, &tip)
+	if err != nil {
+		return err
+	}
+	if unlocked == false {
+		return ErrSequenceLocked
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"blockchain/main/script"
+	"testing"
+)
+
+func newLockedTx(lockTime uint32, sequence uint32) *Transaction {
+	input := TxInput{[]byte{1}, 0, nil, sequence}
+
+	return &Transaction{nil, TxVersion, []TxInput{input}, nil, lockTime}
+}
+
+func TestIsFinal(t *testing.T) {
+	byHeight := newLockedTx(100, inputSequence(100))
+	if byHeight.IsFinal(99, 0) {
+		t.Fatal("height lock time passed a block early")
+	}
+	if byHeight.IsFinal(100, 0) == false {
+		t.Fatal("height lock time not passed at its height")
+	}
+
+	lockTime := uint32(script.LockTimeThreshold + 1000)
+	byTime := newLockedTx(lockTime, inputSequence(lockTime))
+	if byTime.IsFinal(1000000, int64(lockTime)-1) {
+		t.Fatal("time lock passed before the median time past reached it")
+	}
+	if byTime.IsFinal(0, int64(lockTime)) == false {
+		t.Fatal("time lock not passed at its time")
+	}
+
+	// Final inputs disable the lock time
+	if newLockedTx(100, script.MaxSequence).IsFinal(0, 0) == false {
+		t.Fatal("lock time applied with every input final")
+	}
+}
+
+func TestSequenceLocks(t *testing.T) {
+	chain := &BlockChain{Database: database.NewMemoryDatabase()}
+
+	// Blocks every 600 seconds, so the median time past of the block at height h is the timestamp of height (h+1)/2
+	var timestamps []int64
+	for height := 0; height < 12; height++ {
+		timestamps = append(timestamps, 1000+int64(height)*600)
+	}
+	tip := storeTestHeaders(t, chain, InitialBits, timestamps)
+
+	// The output is created at height 3
+	coinHeights := []int{3}
+
+	cases := []struct {
+		sequence uint32
+		parent   int
+		unlocked bool
+	}{
+		// The spend may be in the block 5 blocks after the output
+		{SequenceFromBlocks(5), 6, false},
+		{SequenceFromBlocks(5), 7, true},
+
+		// 1024 seconds after the median time past of height 2, 1600
+		{SequenceFromSeconds(1024), 4, false},
+		{SequenceFromSeconds(1024), 5, true},
+
+		{script.SequenceDisableFlag | SequenceFromBlocks(100), 3, true},
+	}
+
+	for _, c := range cases {
+		parent, err := chain.Ancestor(tip, c.parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		unlocked, err := chain.checkSequenceLocks(newLockedTx(0, c.sequence), coinHeights, parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unlocked != c.unlocked {
+			t.Fatalf("sequence %08x with parent %d: expected %v, got %v", c.sequence, c.parent, c.unlocked, unlocked)
+		}
+	}
+}
@@ -1,12 +1,33 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
 	"log"
 )
 
+// Prefixes separating the hashes of leaves from the hashes of interior nodes,
+// so that a node can not be passed off as a leaf. Blocks before TaggedMerkleVersion hash both plainly
+const (
+	merkleLeafTag = 0x00
+	merkleNodeTag = 0x01
+)
+
+var ErrBadProofIndex = errors.New("leaf index is out of range")
+
 type MerkleTree struct {
 	RootNode *MerkleNode
+
+	// Nodes of every level from the leaves up, kept to build inclusion proofs
+	levels [][]MerkleNode
+	leaves int
+}
+
+// Hash of the node next to the path from a leaf to the root
+type MerkleProofStep struct {
+	Hash []byte
+	Left bool
 }
 
 type MerkleNode struct {
@@ -16,15 +37,16 @@ type MerkleNode struct {
 }
 
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
+	return newMerkleNode(left, right, data, false)
+}
+
+func newMerkleNode(left, right *MerkleNode, data []byte, legacy bool) *MerkleNode {
 	node := MerkleNode{}
 
 	if left == nil && right == nil {
-		hash := sha256.Sum256(data)
-		node.Data = hash[:]
+		node.Data = merkleLeafHash(data, legacy)
 	} else {
-		prevHashes := append(left.Data, right.Data...)
-		hash := sha256.Sum256(prevHashes)
-		node.Data = hash[:]
+		node.Data = merkleNodeHash(left.Data, right.Data, legacy)
 	}
 
 	node.Left = left
@@ -33,11 +55,41 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &node
 }
 
+func merkleLeafHash(data []byte, legacy bool) []byte {
+	if legacy == false {
+		data = append([]byte{merkleLeafTag}, data...)
+	}
+	hash := sha256.Sum256(data)
+
+	return hash[:]
+}
+
+func merkleNodeHash(left, right []byte, legacy bool) []byte {
+	var data []byte
+	if legacy == false {
+		data = append(data, merkleNodeTag)
+	}
+	data = append(append(data, left...), right...)
+	hash := sha256.Sum256(data)
+
+	return hash[:]
+}
+
+// Builds the tree with domain separated leaf and node hashes
 func NewMerkleTree(data [][]byte) *MerkleTree {
+	return buildMerkleTree(data, false)
+}
+
+// Builds the tree the way blocks before TaggedMerkleVersion do
+func NewLegacyMerkleTree(data [][]byte) *MerkleTree {
+	return buildMerkleTree(data, true)
+}
+
+func buildMerkleTree(data [][]byte, legacy bool) *MerkleTree {
 	var nodes []MerkleNode
 
 	for _, dat := range data {
-		node := NewMerkleNode(nil, nil, dat)
+		node := newMerkleNode(nil, nil, dat, legacy)
 		nodes = append(nodes, *node)
 	}
 
@@ -45,21 +97,64 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		log.Panic("No merkel nodes")
 	}
 
+	var levels [][]MerkleNode
+
 	for len(nodes) > 1 {
 		if len(nodes)%2 != 0 {
 			nodes = append(nodes, nodes[len(nodes)-1])
 		}
+		levels = append(levels, nodes)
 
 		var level []MerkleNode
 		for i := 0; i < len(nodes); i += 2 {
-			node := NewMerkleNode(&nodes[i], &nodes[i+1], nil)
+			node := newMerkleNode(&nodes[i], &nodes[i+1], nil, legacy)
 			level = append(level, *node)
 		}
 
 		nodes = level
 	}
 
-	tree := MerkleTree{&nodes[0]}
+	levels = append(levels, nodes)
+	tree := MerkleTree{&nodes[0], levels, len(data)}
 
 	return &tree
 }
+
+// Returns the sibling hashes on the path from the leaf at index to the root
+func (tree *MerkleTree) Proof(index int) ([]MerkleProofStep, error) {
+	if index < 0 || index >= tree.leaves {
+		return nil, ErrBadProofIndex
+	}
+
+	var proof []MerkleProofStep
+
+	for _, level := range tree.levels[:len(tree.levels)-1] {
+		if index%2 == 0 {
+			proof = append(proof, MerkleProofStep{level[index+1].Data, false})
+		} else {
+			proof = append(proof, MerkleProofStep{level[index-1].Data, true})
+		}
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// Reports whether the proof links the leaf data to the root of a domain separated tree
+func VerifyMerkleProof(leaf []byte, proof []MerkleProofStep, root []byte) bool {
+	return verifyMerkleProof(leaf, proof, root, false)
+}
+
+func verifyMerkleProof(leaf []byte, proof []MerkleProofStep, root []byte, legacy bool) bool {
+	current := merkleLeafHash(leaf, legacy)
+
+	for _, step := range proof {
+		if step.Left {
+			current = merkleNodeHash(step.Hash, current, legacy)
+		} else {
+			current = merkleNodeHash(current, step.Hash, legacy)
+		}
+	}
+
+	return bytes.Compare(current, root) == 0
+}
@@ -0,0 +1,131 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Roots of the trees whose leaves are the ASCII bytes of the listed strings
+var merkleVectors = []struct {
+	leaves string
+	root   string
+	legacy string
+}{
+	{"a", "022a6979e6dab7aa5ae4c3e5e45f7e977112a7e63593820dbec1ec738a24f93c", "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"},
+	{"a b", "b137985ff484fb600db93107c77b0365c80d78f5b429ded0fd97361d077999eb", "e5a01fee14e0ed5c48714f22180f25ad8365b53f9779f79dc4a3d7e93963f94a"},
+	{"a b c", "e9636069c740c9ff51625b01a0b040396d265a9b920cc6febdfa5ecc9f58ecce", "d31a37ef6ac14a2db1470c4316beb5592e6afd4465022339adafda76a18ffabe"},
+	{"a b c c", "e9636069c740c9ff51625b01a0b040396d265a9b920cc6febdfa5ecc9f58ecce", "d31a37ef6ac14a2db1470c4316beb5592e6afd4465022339adafda76a18ffabe"},
+	{"a b c d", "33376a3bd63e9993708a84ddfe6c28ae58b83505dd1fed711bd924ec5a6239f0", "14ede5e8e97ad9372327728f5099b95604a39593cac3bd38a343ad76205213e7"},
+	{"a b c d e", "605c72ca9351dd39f38678f4c1326df06d8fb1a58272792acaf70e8c191fb823", "dd14d0ba516bb654a3052b76f051db026f4e322d0be081468fab99440f9e7305"},
+}
+
+func merkleLeaves(leaves string) [][]byte {
+	var data [][]byte
+	for _, leaf := range strings.Fields(leaves) {
+		data = append(data, []byte(leaf))
+	}
+
+	return data
+}
+
+func TestMerkleRoots(t *testing.T) {
+	for _, v := range merkleVectors {
+		data := merkleLeaves(v.leaves)
+
+		if root := hex.EncodeToString(NewMerkleTree(data).RootNode.Data); root != v.root {
+			t.Errorf("%s: root %s, expected %s", v.leaves, root, v.root)
+		}
+		if root := hex.EncodeToString(NewLegacyMerkleTree(data).RootNode.Data); root != v.legacy {
+			t.Errorf("%s: version 1 root %s, expected %s", v.leaves, root, v.legacy)
+		}
+	}
+}
+
+func TestInteriorNodesAreNotLeaves(t *testing.T) {
+	// The two interior nodes of a b c d, taken as a single leaf
+	leaf, _ := hex.DecodeString("e5a01fee14e0ed5c48714f22180f25ad8365b53f9779f79dc4a3d7e93963f94a" +
+		"bffe0b34dba16bc6fac17c08bac55d676cded5a4ade41fe2c9924a5dde8f3e5b")
+
+	if root := hex.EncodeToString(NewLegacyMerkleTree([][]byte{leaf}).RootNode.Data); root != merkleVectors[4].legacy {
+		t.Fatal("version 1 root of the interior nodes is", root)
+	}
+
+	root := hex.EncodeToString(NewMerkleTree([][]byte{leaf}).RootNode.Data)
+	if root != "e96de2d87981e678ec191b74bb8df10741fef7b9010ba95cc7c3ed720ac476fe" || root == merkleVectors[4].root {
+		t.Fatal("interior nodes pass for a leaf with tagged hashes", root)
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for _, v := range merkleVectors {
+		data := merkleLeaves(v.leaves)
+
+		for _, legacy := range []bool{false, true} {
+			tree := buildMerkleTree(data, legacy)
+
+			for i, leaf := range data {
+				proof, err := tree.Proof(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if verifyMerkleProof(leaf, proof, tree.RootNode.Data, legacy) == false {
+					t.Errorf("%s: proof of leaf %d does not verify", v.leaves, i)
+				}
+				if verifyMerkleProof([]byte("x"), proof, tree.RootNode.Data, legacy) {
+					t.Errorf("%s: proof of leaf %d verifies another leaf", v.leaves, i)
+				}
+
+				// A leaf paired with itself verifies on either side
+				if len(proof) > 0 && bytes.Equal(proof[0].Hash, merkleLeafHash(leaf, legacy)) == false {
+					proof[0].Left = !proof[0].Left
+					if verifyMerkleProof(leaf, proof, tree.RootNode.Data, legacy) {
+						t.Errorf("%s: proof of leaf %d verifies with a swapped sibling", v.leaves, i)
+					}
+				}
+			}
+
+			if _, err := tree.Proof(len(data)); err != ErrBadProofIndex {
+				t.Fatalf("expected %v, got %v", ErrBadProofIndex, err)
+			}
+		}
+	}
+}
+
+func TestDuplicateTransactionsAreRejected(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	address := string(w.Address())
+	mineTestBlocks(chain, w, 1)
+
+	second, err := chain.GetBlockByHeight(first.Height + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(20, address))
+	b := newTestSpend(chain, w, second.Transactions[0], *NewTXOutput(20, address))
+	coinbase := CoinbaseTx(address, "", chain.GetBestHeight()+1, 0)
+	block := newTestBlock(t, chain, chain.LastHash, coinbase, a, b)
+
+	// With the last transaction repeated the block has the same merkle root and hash
+	mutated := *block
+	mutated.Transactions = append(append([]*Transaction{}, block.Transactions...), b)
+	if bytes.Equal(mutated.MerkleTree().RootNode.Data, block.MerkleRoot) == false {
+		t.Fatal("repeating the last transaction changed the merkle root")
+	}
+
+	if err := chain.AddBlock(&mutated); errors.Is(err, ErrDuplicateTx) == false {
+		t.Fatalf("expected %v, got %v", ErrDuplicateTx, err)
+	}
+
+	// Rejecting the mutated block must not get the valid one rejected
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(chain.Tip(), block.Hash) == false {
+		t.Fatal("valid block is not the tip")
+	}
+}
@@ -0,0 +1,172 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/sha256"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Nonces tried for one header before the timestamp or the extra nonce is rolled
+	maxNonce = math.MaxUint32
+
+	// Hashes a worker computes between checks for cancellation
+	hashBatch = 1024
+)
+
+// Searches for proof of work on all cores. The nonce space is split between the workers
+type Miner struct {
+	Workers int
+
+	hashes     uint64
+	mutex      sync.Mutex
+	started    time.Time
+	extraNonce uint64
+}
+
+// Creates a miner with the given number of workers, one per CPU when workers is not positive
+func NewMiner(workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	return &Miner{Workers: workers}
+}
+
+// Returns the number of hashes computed by the current or last Mine call
+func (m *Miner) Hashes() uint64 {
+	return atomic.LoadUint64(&m.hashes)
+}
+
+// Returns the hashes per second of the current or last Mine call
+func (m *Miner) HashRate() float64 {
+	m.mutex.Lock()
+	started := m.started
+	m.mutex.Unlock()
+
+	elapsed := time.Since(started).Seconds()
+	if started.IsZero() || elapsed == 0 {
+		return 0
+	}
+
+	return float64(m.Hashes()) / elapsed
+}
+
+// Finds a nonce meeting the block target and sets the block hash. When the nonce space runs out
+// the timestamp is moved to the current time, or the coinbase extra nonce is changed if the time has not moved.
+// Returns the context error when mining is cancelled before a solution is found
+func (m *Miner) Mine(ctx context.Context, block *Block) error {
+	m.mutex.Lock()
+	m.started = time.Now()
+	m.mutex.Unlock()
+	atomic.StoreUint64(&m.hashes, 0)
+	m.extraNonce = 0
+
+	for {
+		nonce, found, err := m.search(ctx, &block.BlockHeader)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			block.Nonce = nonce
+			block.Hash = block.BlockHeader.Hash()
+
+			return nil
+		}
+
+		m.roll(block)
+	}
+}
+
+// Tries every nonce of the header. found is false when the nonce space ran out
+func (m *Miner) search(ctx context.Context, header *BlockHeader) (int, bool, error) {
+	target := NewProof(header).Target
+
+	// Stops the other workers once a solution is found
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	solution := make(chan int, 1)
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < m.Workers; worker++ {
+		wg.Add(1)
+
+		go func(first int) {
+			defer wg.Done()
+
+			h := *header
+			var intHash big.Int
+			count := uint64(0)
+
+			for nonce := first; nonce <= maxNonce; nonce += m.Workers {
+				h.Nonce = nonce
+				hash := sha256.Sum256(h.Serialize())
+				intHash.SetBytes(hash[:])
+				count++
+
+				if intHash.Cmp(target) == -1 {
+					select {
+					case solution <- nonce:
+					default:
+					}
+					cancel()
+					break
+				}
+
+				if count%hashBatch == 0 {
+					atomic.AddUint64(&m.hashes, hashBatch)
+
+					select {
+					case <-workCtx.Done():
+						return
+					default:
+					}
+				}
+			}
+
+			atomic.AddUint64(&m.hashes, count%hashBatch)
+		}(worker)
+	}
+
+	wg.Wait()
+
+	select {
+	case nonce := <-solution:
+		return nonce, true, nil
+	default:
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+
+	return 0, false, nil
+}
+
+// Changes the header so that the nonce space can be searched again
+func (m *Miner) roll(block *Block) {
+	if now := AdjustedTime(); now > block.Timestamp {
+		block.Timestamp = now
+		return
+	}
+
+	// The extra nonce replaces the last bytes of the coinbase data
+	coinbase := block.Transactions[0]
+	m.extraNonce++
+
+	data := coinbase.Inputs[0].Script
+	if m.extraNonce > 1 && len(data) >= 8 {
+		data = data[:len(data)-8]
+	}
+	coinbase.Inputs[0].Script = append(append([]byte{}, data...), ToHex(int64(m.extraNonce))...)
+
+	coinbase.ID = coinbase.Hash()
+	block.MerkleRoot = block.HashTransactions()
+}
@@ -0,0 +1,80 @@
+package blockchain
+
+import (
+	"blockchain/main/wallet"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMiningStopsWhenCancelled(t *testing.T) {
+	coinbase := CoinbaseTx(string(wallet.MakeWallet().Address()), "", 1, 0)
+
+	// No hash meets a zero target
+	block := &Block{BlockHeader{BlockVersion, []byte{}, nil, AdjustedTime(), 0, 0, 1}, nil, []*Transaction{coinbase}}
+	block.MerkleRoot = block.HashTransactions()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	miner := NewMiner(2)
+	done := make(chan error, 1)
+	go func() { done <- miner.Mine(ctx, block) }()
+
+	select {
+	case err := <-done:
+		if errors.Is(err, context.DeadlineExceeded) == false {
+			t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mining did not stop")
+	}
+
+	if miner.Hashes() == 0 {
+		t.Fatal("no hashes were counted")
+	}
+}
+
+func TestExtraNonceRolls(t *testing.T) {
+	coinbase := CoinbaseTx(string(wallet.MakeWallet().Address()), "", 1, 0)
+	data := coinbase.Inputs[0].Script
+
+	// The timestamp cannot move forward, so the coinbase changes instead
+	timestamp := AdjustedTime() + 60
+	block := &Block{BlockHeader{BlockVersion, []byte{}, nil, timestamp, InitialBits, 0, 1}, nil, []*Transaction{coinbase}}
+	block.MerkleRoot = block.HashTransactions()
+
+	miner := NewMiner(1)
+	var roots [][]byte
+	for i := 0; i < 3; i++ {
+		miner.roll(block)
+
+		if block.Timestamp != timestamp {
+			t.Fatal("timestamp moved")
+		}
+		if len(coinbase.Inputs[0].Script) != len(data)+8 || bytes.HasPrefix(coinbase.Inputs[0].Script, data) == false {
+			t.Fatal("extra nonce does not replace the last one")
+		}
+		if coinbase.CheckID() == false || bytes.Equal(block.MerkleRoot, block.HashTransactions()) == false {
+			t.Fatal("coinbase ID or merkle root is not updated")
+		}
+		for _, root := range roots {
+			if bytes.Equal(root, block.MerkleRoot) {
+				t.Fatal("rolling the extra nonce repeated a merkle root")
+			}
+		}
+		roots = append(roots, block.MerkleRoot)
+	}
+	if coinbase.HasCoinbaseHeight(1) == false {
+		t.Fatal("extra nonce overwrote the height")
+	}
+
+	// Once the clock has moved, the timestamp is rolled
+	block.Timestamp = AdjustedTime() - 60
+	miner.roll(block)
+	if block.Timestamp < AdjustedTime()-1 {
+		t.Fatal("timestamp was not moved to the current time")
+	}
+}
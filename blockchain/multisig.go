@@ -0,0 +1,172 @@
+package blockchain
+
+import (
+	"blockchain/main/script"
+	"blockchain/main/wallet"
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// Creates an unsigned transaction sending amount from the pay-to-script-hash address of the
+// multisig redeem script. The signers add their signatures with SignMultisig one after another
+func NewMultisigTransaction(redeemScript []byte, to string, amount, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
+	var inputs []TxInput
+	var outputs []TxOutput
+
+	if _, _, ok := script.ExtractMultisig(redeemScript); ok == false {
+		log.Panic("Error: redeem script is not a multisig script")
+	}
+
+	scriptHash := wallet.PublicKeyHash(redeemScript)
+	acc, validOutputs := UTXO.FindSpendableOutputs(scriptHash, amount+fee)
+
+	if acc < amount+fee {
+		log.Panic("Error: not enough funds")
+	}
+
+	for encodedTxID, outs := range validOutputs {
+		txID, err := hex.DecodeString(encodedTxID)
+		Handle(err)
+
+		for _, out := range outs {
+			// Signing adds the redeem script to the unlocking script
+			input := TxInput{txID, out, script.MultisigScriptHashUnlock(nil, redeemScript), inputSequence(lockTime)}
+			inputs = append(inputs, input)
+		}
+	}
+
+	from := fmt.Sprintf("%s", wallet.ScriptAddress(redeemScript))
+
+	outputs = append(outputs, *NewTXOutput(amount, to))
+
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from))
+	}
+
+	tx := Transaction{nil, TxVersion, inputs, outputs, lockTime}
+	tx.ID = tx.Hash()
+
+	return &tx
+}
+
+// Adds the signature of the private key to every input spending an output locked to the redeem script.
+// An input keeps the signatures made so far, in the order of their keys, followed by the redeem script.
+// Signatures only cover the transaction without unlocking scripts, so signers can sign in any order.
+// Returns the number of inputs signed
+func (tx *Transaction) SignMultisig(privateKey ecdsa.PrivateKey, redeemScript []byte, prevTXs map[string]Transaction) int {
+	m, keys, ok := script.ExtractMultisig(redeemScript)
+	if ok == false || tx.IsCoinbase() {
+		return 0
+	}
+
+	pubKeys := wallet.PublicKeyEncodings(privateKey.PublicKey)
+	signed := 0
+
+	for inId, in := range tx.Inputs {
+		prevTX, ok := prevTXs[hex.EncodeToString(in.ID)]
+		if ok == false || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			continue
+		}
+
+		locking := prevTX.Outputs[in.Out].Script
+		if bytes.Equal(script.ExtractScriptHash(locking), script.Hash160(redeemScript)) == false {
+			continue
+		}
+
+		hash := tx.SignatureHash(inId, locking)
+		sigs := multisigSignatures(in.Script, keys, hash)
+
+		for i, key := range keys {
+			for _, pubKey := range pubKeys {
+				if bytes.Equal(key, pubKey) && sigs[i] == nil && len(sigs) < m {
+					sigs[i] = wallet.Sign(privateKey, hash)
+					signed++
+				}
+			}
+		}
+
+		var ordered [][]byte
+		for i := range keys {
+			if sigs[i] != nil {
+				ordered = append(ordered, sigs[i])
+			}
+		}
+
+		tx.Inputs[inId].Script = script.MultisigScriptHashUnlock(ordered, redeemScript)
+	}
+
+	tx.ID = tx.Hash()
+
+	return signed
+}
+
+// Returns the number of signatures still missing before every input spending
+// a multisig pay-to-script-hash output can be unlocked
+func (tx *Transaction) MissingSignatures(prevTXs map[string]Transaction) int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+
+	missing := 0
+
+	for inId, in := range tx.Inputs {
+		prevTX, ok := prevTXs[hex.EncodeToString(in.ID)]
+		if ok == false || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			continue
+		}
+
+		locking := prevTX.Outputs[in.Out].Script
+		redeemScript := MultisigRedeemScript(in.Script)
+		if bytes.Equal(script.ExtractScriptHash(locking), script.Hash160(redeemScript)) == false {
+			continue
+		}
+
+		m, keys, _ := script.ExtractMultisig(redeemScript)
+		sigs := multisigSignatures(in.Script, keys, tx.SignatureHash(inId, locking))
+
+		if len(sigs) < m {
+			missing += m - len(sigs)
+		}
+	}
+
+	return missing
+}
+
+// Returns the multisig redeem script the unlocking script ends with, nil if there is none
+func MultisigRedeemScript(unlocking []byte) []byte {
+	pushes, ok := script.ExtractPushes(unlocking)
+	if ok == false || len(pushes) == 0 {
+		return nil
+	}
+
+	redeemScript := pushes[len(pushes)-1]
+	if _, _, ok := script.ExtractMultisig(redeemScript); ok == false {
+		return nil
+	}
+
+	return redeemScript
+}
+
+// Returns the valid signatures of the hash in a multisig unlocking script by the index of their key
+func multisigSignatures(unlocking []byte, keys [][]byte, hash []byte) map[int][]byte {
+	sigs := make(map[int][]byte)
+
+	pushes, ok := script.ExtractPushes(unlocking)
+	if ok == false || len(pushes) == 0 {
+		return sigs
+	}
+
+	for _, sig := range pushes[:len(pushes)-1] {
+		for i, key := range keys {
+			if sigs[i] == nil && wallet.VerifySignature(key, hash, sig) {
+				sigs[i] = sig
+				break
+			}
+		}
+	}
+
+	return sigs
+}
@@ -0,0 +1,58 @@
+package blockchain
+
+import (
+	"blockchain/main/script"
+	"blockchain/main/wallet"
+	"testing"
+)
+
+func TestTwoOfThreeMultisig(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	address := string(w.Address())
+	to := string(wallet.MakeWallet().Address())
+
+	signers := []*wallet.Wallet{wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()}
+	var pubKeys [][]byte
+	for _, signer := range signers {
+		pubKeys = append(pubKeys, signer.PublicKey)
+	}
+	redeemScript := script.Multisig(2, pubKeys)
+
+	funding := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(20, string(wallet.ScriptAddress(redeemScript))))
+	chain.MineBlock([]*Transaction{CoinbaseTx(address, "", chain.GetBestHeight()+1, 0), funding})
+
+	UTXO := UTXOSet{chain}
+	tx := NewMultisigTransaction(redeemScript, to, 15, 1, 0, &UTXO)
+	if missing := chain.MissingSignatures(tx); missing != 2 {
+		t.Fatalf("expected %d missing signatures, got %d", 2, missing)
+	}
+
+	if chain.SignMultisigTransaction(tx, wallet.MakeWallet().PrivateKey, redeemScript) != 0 {
+		t.Fatal("a key outside the multisig signed")
+	}
+
+	// Signers may sign out of the order of their keys
+	if chain.SignMultisigTransaction(tx, signers[2].PrivateKey, redeemScript) != 1 {
+		t.Fatal("signer did not sign")
+	}
+	if chain.MissingSignatures(tx) != 1 || chain.VerifyTransaction(tx) {
+		t.Fatal("one signature unlocked the 2-of-3 multisig")
+	}
+
+	if chain.SignMultisigTransaction(tx, signers[0].PrivateKey, redeemScript) != 1 {
+		t.Fatal("signer did not sign")
+	}
+	if chain.MissingSignatures(tx) != 0 || chain.VerifyTransaction(tx) == false {
+		t.Fatal("two signatures did not unlock the 2-of-3 multisig")
+	}
+
+	// No more signatures are needed
+	if chain.SignMultisigTransaction(tx, signers[1].PrivateKey, redeemScript) != 0 {
+		t.Fatal("third signer signed a complete transaction")
+	}
+
+	block := newTestBlock(t, chain, chain.LastHash, CoinbaseTx(address, "", chain.GetBestHeight()+1, 1), tx)
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,75 +4,44 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
 	"log"
-	"math"
 	"math/big"
 )
 
-// PoW difficulty
+// Leading zero bits of the genesis block target
 const Difficulty = 12
 
 // Represents proof of work
 type ProofOfWork struct {
-	Block  *Block
+	Header *BlockHeader
 	Target *big.Int
 }
 
-// Create new PoW
-func NewProof(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+// Create new PoW for the target the header commits to
+func NewProof(h *BlockHeader) *ProofOfWork {
+	target := CompactToBig(h.Bits)
 
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{h, target}
 
 	return pow
 }
 
+// Returns the encoded header with the given nonce
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
-		},
-		[]byte{},
-	)
-
-	return data
-}
-
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
-
-	nonce := 0
-
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
-
-		fmt.Printf("\r%x", hash)
-		intHash.SetBytes(hash[:])
+	header := *pow.Header
+	header.Nonce = nonce
 
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
-		}
-
-	}
-
-	fmt.Println()
-
-	return nonce, hash[:]
+	return header.Serialize()
 }
 
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 
-	data := pow.InitData(pow.Block.Nonce)
+	if pow.Target.Sign() <= 0 || pow.Target.Cmp(powLimit) > 0 {
+		return false
+	}
+
+	data := pow.InitData(pow.Header.Nonce)
 
 	hash := sha256.Sum256(data)
 	intHash.SetBytes(hash[:])
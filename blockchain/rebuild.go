@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"bytes"
+)
+
+var (
+	// Markers of interrupted rebuilds -> tip the rebuild was started at and the block it continues from
+	blocksRebuildKey  = []byte("rebuild-blocks")
+	undoRebuildKey    = []byte("rebuild-undo")
+	utxoRebuildKey    = []byte("rebuild-utxo")
+	historyRebuildKey = []byte("rebuild-history")
+
+	// Block a reorganization is moving the UTXO set and the indexes to
+	reorgKey = []byte("rt")
+
+	// Changes written at most in one database transaction by rebuilds and reorganizations
+	maxBatchChanges = 1000
+)
+
+// Batch written in parts, so that rebuilds and reorganizations of any length stay within the
+// transaction size of the database. Parts are only written at checkpoints, where the pending
+// changes leave the database consistent with the markers saved along with them
+type chunkedBatch struct {
+	database.Batch
+	changes int
+}
+
+func newChunkedBatch(db database.Database) *chunkedBatch {
+	return &chunkedBatch{Batch: db.NewBatch()}
+}
+
+func (b *chunkedBatch) Update(key, value []byte) error {
+	b.changes++
+
+	return b.Batch.Update(key, value)
+}
+
+func (b *chunkedBatch) Delete(key []byte) error {
+	b.changes++
+
+	return b.Batch.Delete(key)
+}
+
+func (b *chunkedBatch) Write() error {
+	b.changes = 0
+
+	return b.Batch.Write()
+}
+
+// Writes the pending changes once there are maxBatchChanges of them
+func (b *chunkedBatch) checkpoint() error {
+	if b.changes < maxBatchChanges {
+		return nil
+	}
+
+	return b.Write()
+}
+
+// Returns the block an interrupted rebuild continues from,
+// or nil if it has to start over because the tip moved since
+func (chain *BlockChain) resumeRebuild(key []byte) []byte {
+	data, err := chain.Database.Read(key)
+	if err != nil || len(data) != 2*len(chain.LastHash) || bytes.HasPrefix(data, chain.LastHash) == false {
+		return nil
+	}
+
+	return data[len(chain.LastHash):]
+}
+
+// Saves where a rebuild continues from with the changes of the batch
+func (chain *BlockChain) saveRebuild(batch database.Batch, key, blockHash []byte) error {
+	return batch.Update(key, append(append([]byte{}, chain.LastHash...), blockHash...))
+}
+
+// Moves the UTXO set and the indexes from the block they were last brought up to onto newTip
+// in parts, then makes newTip the tip. The blocks must already have been checked to connect,
+// so their scripts are not run again.
+// A failed write in between leaves a marker from which finishReorganization completes the move
+func (chain *BlockChain) switchTip(newTip *Block) error {
+	stateHash, err := chain.Database.Read(utxoTipKey)
+	if err != nil {
+		return err
+	}
+
+	state, err := chain.GetBlock(stateHash)
+	if err != nil {
+		return err
+	}
+
+	detach, attach, err := chain.branches(&state, newTip)
+	if err != nil {
+		return err
+	}
+
+	batch := newChunkedBatch(chain.Database)
+
+	if err := batch.Update(reorgKey, newTip.Hash); err != nil {
+		return err
+	}
+
+	for _, block := range detach {
+		if err := chain.disconnectTip(batch, block); err != nil {
+			return err
+		}
+		if err := batch.Update(utxoTipKey, block.PrevHash); err != nil {
+			return err
+		}
+		if err := batch.checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	for _, block := range attach {
+		if err := chain.applyBlock(batch, block); err != nil {
+			return err
+		}
+		if err := batch.Update(utxoTipKey, block.Hash); err != nil {
+			return err
+		}
+		if err := batch.checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	if err := setTip(batch, newTip); err != nil {
+		return err
+	}
+
+	if err := batch.Delete(reorgKey); err != nil {
+		return err
+	}
+
+	if err := batch.Write(); err != nil {
+		return err
+	}
+
+	chain.LastHash = newTip.Hash
+
+	return nil
+}
+
+// Completes a reorganization that a failed write or a crash left part way, so that the UTXO set
+// and the indexes are at the tip again before anything is connected on top of them
+func (chain *BlockChain) finishReorganization() error {
+	target, err := chain.Database.Read(reorgKey)
+	if err == database.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	newTip, err := chain.GetBlock(target)
+	if err != nil {
+		return err
+	}
+
+	return chain.switchTip(&newTip)
+}
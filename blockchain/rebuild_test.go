@@ -0,0 +1,235 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"blockchain/main/wallet"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// Database whose batches stop being written after a number of writes, the way a crash stops an update.
+// The given number of writes then fail, all of them if it is negative
+type interruptedDatabase struct {
+	database.Database
+	writes   int
+	failures int
+}
+
+type interruptedBatch struct {
+	database.Batch
+	db *interruptedDatabase
+}
+
+func (db *interruptedDatabase) NewBatch() database.Batch {
+	return &interruptedBatch{db.Database.NewBatch(), db}
+}
+
+func (b *interruptedBatch) Write() error {
+	if b.db.writes > 0 {
+		b.db.writes--
+		return b.Batch.Write()
+	}
+
+	if b.db.failures == 0 {
+		return b.Batch.Write()
+	}
+	b.db.failures--
+
+	return errInterrupted
+}
+
+// Writes every batch of the test in parts of the given number of changes
+func setMaxBatchChanges(t *testing.T, changes int) {
+	max := maxBatchChanges
+	maxBatchChanges = changes
+	t.Cleanup(func() { maxBatchChanges = max })
+}
+
+func databaseContents(t *testing.T, db database.Database) map[string]string {
+	contents := make(map[string]string)
+
+	err := db.Iterate([]byte{}, func(key, val []byte) error {
+		contents[string(key)] = string(val)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return contents
+}
+
+func sameContents(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, val := range a {
+		if other, ok := b[key]; ok == false || other != val {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Creates a chain with the address history enabled and a block spending to another address
+func newRebuildTestChain(t *testing.T) *BlockChain {
+	chain, w, first := newTestChain(t)
+	chain.EnableAddressHistory()
+
+	to := string(wallet.MakeWallet().Address())
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(15, to), *NewTXOutput(5, string(w.Address())))
+	chain.MineBlock([]*Transaction{CoinbaseTx(to, "", chain.GetBestHeight()+1, 0), tx})
+
+	return chain
+}
+
+func TestRebuildsInPartsKeepTheState(t *testing.T) {
+	chain := newRebuildTestChain(t)
+	contents := databaseContents(t, chain.Database)
+
+	setMaxBatchChanges(t, 1)
+
+	chain.ReindexBlocks()
+	chain.ReindexUndo()
+	UTXOSet{chain}.Reindex()
+	chain.EnableAddressHistory()
+
+	if sameContents(contents, databaseContents(t, chain.Database)) == false {
+		t.Fatal("rebuilding changed the database")
+	}
+}
+
+func TestInterruptedReindexResumes(t *testing.T) {
+	chain := newRebuildTestChain(t)
+	contents := databaseContents(t, chain.Database)
+
+	setMaxBatchChanges(t, 1)
+
+	interrupted := &BlockChain{LastHash: chain.LastHash, Database: &interruptedDatabase{chain.Database, 40, -1}}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("reindex was not interrupted")
+			}
+		}()
+		UTXOSet{interrupted}.Reindex()
+	}()
+
+	if _, err := chain.Database.Read(utxoRebuildKey); err != nil {
+		t.Fatal("interrupted reindex left no marker")
+	}
+	if _, err := chain.Database.Read(utxoTipKey); err == nil {
+		t.Fatal("partly rebuilt UTXO set is marked up to date")
+	}
+
+	chain = LoadBlockChain(chain.Database)
+
+	if sameContents(contents, databaseContents(t, chain.Database)) == false {
+		t.Fatal("resumed reindex did not rebuild the UTXO set")
+	}
+}
+
+// Creates a chain and the last block of a heavier branch, whose other blocks are stored. The copy
+// of the chain is switched to the branch without interruption
+func newReorgTestChain(t *testing.T) (*BlockChain, *Block, *BlockChain) {
+	chain, w, _ := newTestChain(t)
+	chain.EnableAddressHistory()
+	address := string(w.Address())
+	fork := chain.Tip()
+
+	mineTestBlocks(chain, w, 2)
+
+	// Stored up to its last block while it has no more work than the main chain
+	var branch []*Block
+	parentHash := fork
+	for len(branch) < 3 {
+		parent, err := chain.GetBlockHeader(parentHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block := newTestBlock(t, chain, parentHash, CoinbaseTx(address, "branch", parent.Height+1, 0))
+		branch = append(branch, block)
+		parentHash = block.Hash
+
+		if len(branch) < 3 {
+			if err := chain.AddBlock(block); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	newTip := branch[2]
+
+	other := copyTestChain(t, chain)
+	if err := other.AddBlock(newTip); err != nil {
+		t.Fatal(err)
+	}
+
+	return chain, newTip, other
+}
+
+func TestInterruptedReorganizationIsFinished(t *testing.T) {
+	chain, newTip, other := newReorgTestChain(t)
+
+	setMaxBatchChanges(t, 1)
+
+	// The new block and the first part of the switch are written
+	interrupted := &BlockChain{LastHash: chain.LastHash, Database: &interruptedDatabase{chain.Database, 2, -1}}
+	if err := interrupted.AddBlock(newTip); errors.Is(err, errInterrupted) == false {
+		t.Fatalf("expected %v, got %v", errInterrupted, err)
+	}
+
+	if _, err := chain.Database.Read(reorgKey); err != nil {
+		t.Fatal("interrupted reorganization left no marker")
+	}
+
+	chain = LoadBlockChain(chain.Database)
+
+	if bytes.Equal(chain.Tip(), newTip.Hash) == false {
+		t.Fatal("reorganization was not finished")
+	}
+	if sameContents(databaseContents(t, other.Database), databaseContents(t, chain.Database)) == false {
+		t.Fatal("finished reorganization differs from an uninterrupted one")
+	}
+}
+
+func TestFailedReorganizationIsRepaired(t *testing.T) {
+	chain, newTip, other := newReorgTestChain(t)
+
+	setMaxBatchChanges(t, 1)
+
+	// A single write of the switch fails
+	failing := &BlockChain{LastHash: chain.LastHash, Database: &interruptedDatabase{chain.Database, 2, 1}}
+	if err := failing.AddBlock(newTip); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(failing.LastHash, newTip.Hash) == false {
+		t.Fatal("reorganization was not finished")
+	}
+	if sameContents(databaseContents(t, other.Database), databaseContents(t, chain.Database)) == false {
+		t.Fatal("repaired reorganization differs from an uninterrupted one")
+	}
+}
+
+func TestSmallReorganizationIsAtomic(t *testing.T) {
+	chain, newTip, _ := newReorgTestChain(t)
+	oldTip := chain.LastHash
+
+	// The new block is written, the switch is not
+	interrupted := &BlockChain{LastHash: chain.LastHash, Database: &interruptedDatabase{chain.Database, 1, -1}}
+	if err := interrupted.AddBlock(newTip); errors.Is(err, errInterrupted) == false {
+		t.Fatalf("expected %v, got %v", errInterrupted, err)
+	}
+
+	if _, err := chain.Database.Read(reorgKey); err == nil {
+		t.Fatal("switch written in one batch left a marker")
+	}
+	if utxoTip, err := chain.Database.Read(utxoTipKey); err != nil || bytes.Equal(utxoTip, oldTip) == false {
+		t.Fatal("part of the switch was written")
+	}
+}
@@ -0,0 +1,268 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+)
+
+var (
+	workPrefix = []byte("work-")
+
+	// Hash of a block that failed to connect, or of one of its descendants -> nothing
+	invalidPrefix = []byte("invalid-")
+
+	ErrNoForkPoint   = errors.New("branches do not share a common block")
+	ErrInvalidBranch = errors.New("block is on a branch known to be invalid")
+)
+
+func workKey(blockHash []byte) []byte {
+	return append(append([]byte{}, workPrefix...), blockHash...)
+}
+
+func invalidKey(blockHash []byte) []byte {
+	return append(append([]byte{}, invalidPrefix...), blockHash...)
+}
+
+// Returns the expected number of hashes needed to find the block, 2^256 / (target + 1)
+func (h *BlockHeader) Work() *big.Int {
+	target := new(big.Int).Add(NewProof(h).Target, big.NewInt(1))
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	return work.Div(work, target)
+}
+
+// Returns the cumulative work of the chain ending with the given block.
+// Blocks stored before work tracking existed get their work computed and saved
+func (chain *BlockChain) ChainWork(blockHash []byte) (*big.Int, error) {
+	data, err := chain.Database.Read(workKey(blockHash))
+	if err == nil {
+		return new(big.Int).SetBytes(data), nil
+	}
+
+	block, err := chain.GetBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	work := block.Work()
+	if len(block.PrevHash) > 0 {
+		parentWork, err := chain.ChainWork(block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		work.Add(work, parentWork)
+	}
+
+	err = chain.Database.Update(workKey(blockHash), work.Bytes())
+
+	return work, err
+}
+
+// Stores a block whose parent is known and switches to its branch
+// if it has more cumulative work than the current tip
+func (chain *BlockChain) acceptBlock(block *Block) error {
+	if err := chain.ValidateBlock(block); err != nil {
+		return err
+	}
+
+	if err := chain.finishReorganization(); err != nil {
+		return err
+	}
+
+	parentWork, err := chain.ChainWork(block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	work := new(big.Int).Add(parentWork, block.Work())
+
+	// Blocks extending the tip are connected in one step
+	if bytes.Compare(block.PrevHash, chain.LastHash) == 0 {
+		return chain.connectBlock(block)
+	}
+
+	batch := chain.Database.NewBatch()
+	if err := storeBlock(batch, block, work); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+
+	tipWork, err := chain.ChainWork(chain.LastHash)
+	if err != nil {
+		return err
+	}
+
+	// Ties keep the branch that was seen first
+	if work.Cmp(tipWork) > 0 {
+		return chain.reorganize(block)
+	}
+
+	return nil
+}
+
+// Finds the last block shared by the branches ending with the given blocks
+func (chain *BlockChain) FindForkPoint(a, b *Block) (*Block, error) {
+	for bytes.Compare(a.Hash, b.Hash) != 0 {
+		if a.Height >= b.Height {
+			if len(a.PrevHash) == 0 {
+				return nil, ErrNoForkPoint
+			}
+			parent, err := chain.GetBlock(a.PrevHash)
+			if err != nil {
+				return nil, err
+			}
+			a = &parent
+		} else {
+			if len(b.PrevHash) == 0 {
+				return nil, ErrNoForkPoint
+			}
+			parent, err := chain.GetBlock(b.PrevHash)
+			if err != nil {
+				return nil, err
+			}
+			b = &parent
+		}
+	}
+
+	return a, nil
+}
+
+// Makes the given block the tip of the chain. Blocks of the current branch are disconnected
+// back to the common ancestor and the blocks of the new branch are connected. The whole switch is
+// checked in memory first: if a block of the new branch spends outputs it cannot, nothing is changed,
+// the block is forgotten and it and its descendants are marked invalid. A switch that fits in one
+// database transaction is then written atomically. Larger ones are applied again in parts without
+// running the checks twice, and a failed write is repaired by finishing the switch before the chain
+// is used again
+func (chain *BlockChain) Reorganize(newTip *Block) error {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	return chain.reorganize(newTip)
+}
+
+func (chain *BlockChain) reorganize(newTip *Block) error {
+	if err := chain.finishReorganization(); err != nil {
+		return err
+	}
+
+	oldTip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return err
+	}
+
+	detach, attach, err := chain.branches(&oldTip, newTip)
+	if err != nil {
+		return err
+	}
+
+	// Checks that the new branch connects, and holds the whole switch if it is small enough
+	batch := newChunkedBatch(chain.Database)
+
+	for _, block := range detach {
+		if err := chain.disconnectTip(batch, block); err != nil {
+			return err
+		}
+	}
+
+	for i, block := range attach {
+		if err := chain.connectTip(batch, block); err != nil {
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				chain.forgetBlock(block)
+				chain.markInvalid(attach[i:])
+			}
+			return err
+		}
+	}
+
+	if err := setTip(batch, newTip); err != nil {
+		return err
+	}
+
+	if batch.changes <= maxBatchChanges {
+		if err := batch.Write(); err != nil {
+			return err
+		}
+
+		chain.LastHash = newTip.Hash
+
+		return nil
+	}
+
+	// Part of a larger switch may have been written when a write fails. The UTXO set and the indexes
+	// are moved on to the new tip before the lock is released, so no block is connected on top of them
+	err = chain.switchTip(newTip)
+	if err != nil && chain.finishReorganization() == nil && bytes.Equal(chain.LastHash, newTip.Hash) {
+		return nil
+	}
+
+	return err
+}
+
+// Returns the blocks to disconnect to go from one block to another, from the first down to their
+// common ancestor, and the blocks to connect then, from the common ancestor up to the second
+func (chain *BlockChain) branches(from, to *Block) ([]*Block, []*Block, error) {
+	fork, err := chain.FindForkPoint(from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var detach []*Block
+	for block := from; bytes.Compare(block.Hash, fork.Hash) != 0; {
+		detach = append(detach, block)
+		parent, err := chain.GetBlock(block.PrevHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		block = &parent
+	}
+
+	var attach []*Block
+	for block := to; bytes.Compare(block.Hash, fork.Hash) != 0; {
+		attach = append([]*Block{block}, attach...)
+		parent, err := chain.GetBlock(block.PrevHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		block = &parent
+	}
+
+	return detach, attach, nil
+}
+
+// Removes an invalid block so that the branch built on it is never selected again
+func (chain *BlockChain) forgetBlock(block *Block) {
+	batch := chain.Database.NewBatch()
+
+	err := batch.Delete(block.Hash)
+	Handle(err)
+
+	err = batch.Delete(workKey(block.Hash))
+	Handle(err)
+
+	err = batch.Write()
+	Handle(err)
+}
+
+// Records the blocks as invalid, so that they and the blocks extending them are rejected
+func (chain *BlockChain) markInvalid(blocks []*Block) {
+	batch := chain.Database.NewBatch()
+
+	for _, block := range blocks {
+		err := batch.Update(invalidKey(block.Hash), []byte{})
+		Handle(err)
+	}
+
+	err := batch.Write()
+	Handle(err)
+}
+
+func (chain *BlockChain) isInvalid(blockHash []byte) bool {
+	_, err := chain.Database.Read(invalidKey(blockHash))
+
+	return err == nil
+}
@@ -0,0 +1,85 @@
+package blockchain
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of blocks the median time past is taken over
+	medianTimeBlocks = 11
+
+	// Peer clock offsets further than this from the local clock are ignored
+	maxTimeOffset = 70 * 60
+
+	// Number of peers kept as clock samples
+	maxTimeSamples = 200
+)
+
+var (
+	timeMutex   sync.Mutex
+	timeOffsets = make(map[string]int64)
+	timeOffset  int64
+)
+
+// Records the clock of a peer, as stated in its version message.
+// The network time offset is the median of the offsets of all peers
+func AddTimeSample(peer string, peerTime int64) {
+	timeMutex.Lock()
+	defer timeMutex.Unlock()
+
+	if _, ok := timeOffsets[peer]; ok == false && len(timeOffsets) >= maxTimeSamples {
+		return
+	}
+	timeOffsets[peer] = peerTime - time.Now().Unix()
+
+	var offsets []int64
+	for _, offset := range timeOffsets {
+		offsets = append(offsets, offset)
+	}
+
+	median := medianOf(offsets)
+	if median < -maxTimeOffset || median > maxTimeOffset {
+		median = 0
+	}
+
+	timeOffset = median
+}
+
+// Returns the local clock corrected by the median offset of the peers
+func AdjustedTime() int64 {
+	timeMutex.Lock()
+	defer timeMutex.Unlock()
+
+	return time.Now().Unix() + timeOffset
+}
+
+// Returns the median timestamp of the header and the blocks before it,
+// over at most medianTimeBlocks blocks
+func (chain *BlockChain) MedianTimePast(header *BlockHeader) (int64, error) {
+	var timestamps []int64
+
+	for i := 0; i < medianTimeBlocks; i++ {
+		timestamps = append(timestamps, header.Timestamp)
+
+		if len(header.PrevHash) == 0 {
+			break
+		}
+
+		parent, err := chain.GetBlockHeader(header.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		header = &parent
+	}
+
+	return medianOf(timestamps), nil
+}
+
+func medianOf(values []int64) int64 {
+	sorted := append([]int64{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[len(sorted)/2]
+}
@@ -0,0 +1,108 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Clears the peer clock samples for the test
+func resetTimeSamples(t *testing.T) {
+	offsets, offset := timeOffsets, timeOffset
+	timeOffsets, timeOffset = make(map[string]int64), 0
+	t.Cleanup(func() { timeOffsets, timeOffset = offsets, offset })
+}
+
+func TestMedianTimePast(t *testing.T) {
+	chain := &BlockChain{Database: database.NewMemoryDatabase()}
+
+	// The first two fall out of the last medianTimeBlocks blocks
+	timestamps := []int64{1000, 1000, 50, 40, 30, 20, 10, 60, 70, 80, 90, 100, 110}
+	tip := storeTestHeaders(t, chain, InitialBits, timestamps)
+
+	median, err := chain.MedianTimePast(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if median != 60 {
+		t.Fatalf("expected %d, got %d", 60, median)
+	}
+
+	// Near the genesis the median is taken over the blocks there are
+	parent, err := chain.GetBlockHeader(tip.PrevHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for parent.Height > 2 {
+		parent, err = chain.GetBlockHeader(parent.PrevHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if median, err := chain.MedianTimePast(&parent); err != nil || median != 1000 {
+		t.Fatalf("expected %d, got %d", 1000, median)
+	}
+}
+
+func TestBlockTimeLimits(t *testing.T) {
+	resetTimeSamples(t)
+	chain, w, _ := newTestChain(t)
+	address := string(w.Address())
+
+	parent, err := chain.GetBlockHeader(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	medianTime, err := chain.MedianTimePast(&parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[int64]error{
+		medianTime:                               ErrTimeTooOld,
+		AdjustedTime() + maxFutureBlockTime + 60: ErrTimeTooNew,
+	}
+	for timestamp, expected := range cases {
+		coinbase := CoinbaseTx(address, "", parent.Height+1, 0)
+		block := CreateBlock([]*Transaction{coinbase}, chain.LastHash, parent.Height+1, parent.Bits, timestamp)
+
+		if err := chain.AddBlock(block); errors.Is(err, expected) == false {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+	}
+}
+
+func TestTimeSamples(t *testing.T) {
+	resetTimeSamples(t)
+	now := time.Now().Unix()
+
+	for i := 0; i < 3; i++ {
+		AddTimeSample(fmt.Sprintf("peer %d", i), now+600)
+	}
+	if offset := AdjustedTime() - time.Now().Unix(); offset < 599 || offset > 601 {
+		t.Fatal("adjusted time does not follow the peers", offset)
+	}
+
+	// Once maxTimeSamples peers are known, new ones are not sampled
+	for i := 3; i < maxTimeSamples; i++ {
+		AddTimeSample(fmt.Sprintf("peer %d", i), now+600)
+	}
+	for i := 0; i < maxTimeSamples; i++ {
+		AddTimeSample(fmt.Sprintf("new peer %d", i), now-600)
+	}
+	if len(timeOffsets) != maxTimeSamples {
+		t.Fatalf("expected %d samples, got %d", maxTimeSamples, len(timeOffsets))
+	}
+	if offset := AdjustedTime() - time.Now().Unix(); offset < 599 || offset > 601 {
+		t.Fatal("peers above the limit moved the adjusted time", offset)
+	}
+
+	// Offsets too far from the local clock are not trusted
+	resetTimeSamples(t)
+	AddTimeSample("peer", time.Now().Unix()+2*maxTimeOffset)
+	if offset := AdjustedTime() - time.Now().Unix(); offset > 1 {
+		t.Fatal("adjusted time follows an offset beyond maxTimeOffset", offset)
+	}
+}
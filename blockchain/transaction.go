@@ -1,71 +1,105 @@
 package blockchain
 
 import (
+	"blockchain/main/script"
 	"blockchain/main/wallet"
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"log"
 	"math/big"
 	"strings"
 )
 
+// Block subsidy schedule. The subsidy starts at InitialSubsidy and halves every HalvingInterval blocks
+var (
+	InitialSubsidy  = 20
+	HalvingInterval = 210
+)
+
+// No amount, and no sum of amounts, may be above MaxMoney. It is far above MaxSupply
+// and far below the largest int, so sums of valid amounts cannot overflow
+const MaxMoney = 21000000
+
+// The lock time is the first block height, or median time past, at which the transaction can be mined
 type Transaction struct {
-	ID      []byte
-	Inputs  []TxInput
-	Outputs []TxOutput
+	ID       []byte
+	Version  int
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime uint32
 }
 
+// Returns the transaction ID, the hash of its encoding. From StableIDVersion on the unlocking scripts
+// are left out, so that whoever relays the transaction cannot change its ID by re-encoding a signature.
+// The coinbase keeps its data in the ID, as that is what sets coinbases paying the same reward apart
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
-
-	txCopy := *tx
-	txCopy.ID = []byte{}
-
-	salt := make([]byte, 32)
-	_, err := io.ReadFull(rand.Reader, salt)
-	if err != nil {
-		fmt.Printf("ERROR: Creating salt failed: %s\n", err)
+	data := tx.Serialize()
+
+	switch {
+	case tx.IsCoinbase():
+	case tx.Version < ScriptTxVersion:
+		// Version 1 IDs leave out the signatures but keep the public keys
+		txCopy := tx.TrimmedCopy()
+		for i := range tx.Inputs {
+			_, pubKey := legacyInputFields(&tx.Inputs[i])
+			txCopy.Inputs[i].Script = script.PayToPubKeyHashUnlock(nil, pubKey)
+		}
+		data = txCopy.Serialize()
+	case tx.Version >= StableIDVersion:
+		txCopy := tx.TrimmedCopy()
+		data = txCopy.Serialize()
 	}
 
-	data := txCopy.Serialize()
-	data = append(data, salt...)
-
-	// Perform sha256 on serialized transaction
-	hash = sha256.Sum256(data)
+	hash := sha256.Sum256(data)
 
 	return hash[:]
 }
 
 func (tx Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	var e encoder
+	tx.encode(&e)
+
+	return e.Bytes()
+}
+
+func DeserializeTransaction(data []byte) Transaction {
+	tx, err := DecodeTransaction(data)
+	Handle(err)
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
-	if err != nil {
-		log.Panic(err)
+	return tx
+}
+
+// Returns the amount of new coins a block of the given height may create
+func Subsidy(height int) int {
+	halvings := height / HalvingInterval
+
+	// Shifting further than the width of int is undefined
+	if halvings >= 63 {
+		return 0
 	}
 
-	return encoded.Bytes()
+	return InitialSubsidy >> uint(halvings)
 }
 
-func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
+// Returns the number of coins that will ever be created by block subsidies
+func MaxSupply() int {
+	supply := 0
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
-	Handle(err)
+	for halvings := 0; InitialSubsidy>>uint(halvings) > 0 && halvings < 63; halvings++ {
+		supply += (InitialSubsidy >> uint(halvings)) * HalvingInterval
+	}
 
-	return transaction
+	return supply
 }
 
-func CoinbaseTx(to, data string) *Transaction {
+// Creates the transaction paying the block reward, the subsidy of the block height plus the fees
+// of the block transactions. Its input script pushes the height, which keeps the coinbase ID unique,
+// followed by the data, random unless given
+func CoinbaseTx(to, data string, height, fees int) *Transaction {
 	if data == "" {
 		randData := make([]byte, 24)
 		_, err := rand.Read(randData)
@@ -73,23 +107,62 @@ func CoinbaseTx(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(20, to)
+	unlocking := script.NewBuilder().AddInt(int64(height)).AddData([]byte(data)).Script()
+	txin := TxInput{[]byte{}, -1, unlocking, script.MaxSequence}
+	txout := NewTXOutput(Subsidy(height)+fees, to)
 
-	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
+	tx := Transaction{nil, TxVersion, []TxInput{txin}, []TxOutput{*txout}, 0}
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// Reports whether the coinbase input script starts with the push of the height
+func (tx *Transaction) HasCoinbaseHeight(height int) bool {
+	prefix := script.NewBuilder().AddInt(int64(height)).Script()
+
+	return tx.IsCoinbase() && bytes.HasPrefix(tx.Inputs[0].Script, prefix)
+}
+
+// Creates a transaction sending amount to the address. The fee is left out of the outputs
+// so that the miner including the transaction can claim it. Unless the lock time is 0 the
+// transaction cannot be mined before that block height or median time past
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
+	return newTransaction(w, []TxOutput{*NewTXOutput(amount, to)}, fee, lockTime, UTXO)
+}
+
+// Creates a transaction anchoring the data on chain in an unspendable output.
+// Unless to is empty, it also sends amount to that address
+func NewDataTransaction(w *wallet.Wallet, to string, amount int, data []byte, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
+	var outputs []TxOutput
+	if to != "" {
+		outputs = append(outputs, *NewTXOutput(amount, to))
+	}
+	outputs = append(outputs, *NewTXDataOutput(data))
+
+	return newTransaction(w, outputs, fee, lockTime, UTXO)
+}
+
+// Creates a transaction paying the outputs from the wallet, with the change going back to it
+func newTransaction(w *wallet.Wallet, payments []TxOutput, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
 
+	amount, ok := totalValue(payments)
+	if ok == false {
+		log.Panic("Error: amount is not valid")
+	}
+
+	// A transaction only anchoring data still needs an input
+	needed := amount + fee
+	if needed == 0 {
+		needed = 1
+	}
+
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, needed)
 
-	if acc < amount {
+	if acc < needed {
 		log.Panic("Error: not enough funds")
 	}
 
@@ -98,30 +171,68 @@ func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Tra
 		Handle(err)
 
 		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
+			input := TxInput{txID, out, nil, inputSequence(lockTime)}
 			inputs = append(inputs, input)
 		}
 	}
 
 	from := fmt.Sprintf("%s", w.Address())
 
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	outputs = append(outputs, payments...)
 
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from))
 	}
 
-	tx := Transaction{nil, inputs, outputs}
-	tx.ID = tx.Hash()
+	tx := Transaction{nil, TxVersion, inputs, outputs, lockTime}
 	UTXO.BlockChain.SignTransaction(&tx, w.PrivateKey)
+	tx.ID = tx.Hash()
 
 	return &tx
 }
 
+// Reports whether every data output is well formed, within script.MaxDataCarrierSize and carries
+// no value, since data outputs are unspendable and never enter the UTXO set
+func (tx *Transaction) CheckDataOutputs() bool {
+	for _, out := range tx.Outputs {
+		if out.IsData() == false {
+			continue
+		}
+
+		if _, ok := script.ExtractNullData(out.Script); ok == false || out.Value != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reports whether the ID is the hash of the transaction contents
+func (tx *Transaction) CheckID() bool {
+	return bytes.Compare(tx.ID, tx.Hash()) == 0
+}
+
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
+// Returns the hash an input signature is made over. It covers the transaction with every
+// unlocking script left out and the locking script of the spent output in place of the input's
+func (tx *Transaction) SignatureHash(index int, lockingScript []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Inputs[index].Script = lockingScript
+
+	if tx.Version < ScriptTxVersion {
+		// Version 1 signed the pubkey hash of the spent output in place of the input's public key
+		txCopy.Inputs[index].Script = script.PayToPubKeyHashUnlock(nil, script.ExtractPubKeyHash(lockingScript))
+	}
+
+	hash := sha256.Sum256(txCopy.Serialize())
+
+	return hash[:]
+}
+
+// Signs every input with the private key, unlocking outputs paid to the key's address
 func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
@@ -133,81 +244,126 @@ func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTXs map[string]Tran
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
+	pubKeys := wallet.PublicKeyEncodings(privateKey.PublicKey)
 
-	for inId, in := range txCopy.Inputs {
+	for inId, in := range tx.Inputs {
 		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
-
-		r, s, err := ecdsa.Sign(rand.Reader, &privateKey, []byte(dataToSign))
-		Handle(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+		hash := tx.SignatureHash(inId, prevTX.Outputs[in.Out].Script)
+
+		// The output pays to the hash of the encoding the wallet was created with
+		pubKey := pubKeys[0]
+		for _, encoded := range pubKeys {
+			if bytes.Equal(wallet.PublicKeyHash(encoded), prevTX.Outputs[in.Out].AddressHash()) {
+				pubKey = encoded
+			}
+		}
 
-		tx.Inputs[inId].Signature = signature
-		txCopy.Inputs[inId].PubKey = nil
+		signature := wallet.Sign(privateKey, hash)
+		tx.Inputs[inId].Script = script.PayToPubKeyHashUnlock(signature, pubKey)
 	}
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+// Runs the scripts of every input against the outputs they spend. The transaction is checked
+// as part of a block of the given height whose parent has the given median time past
+func (tx *Transaction) Verify(prevTXs map[string]Transaction, height int, medianTime int64) error {
 	if tx.IsCoinbase() {
-		return true
+		return nil
 	}
 
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("Previous transaction not correct")
+		prevTX, ok := prevTXs[hex.EncodeToString(in.ID)]
+		if ok == false || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return ErrMissingInput
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
 	for inId, in := range tx.Inputs {
-		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
+		locking := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out].Script
+		checker := &txChecker{tx, inId, locking, height, medianTime}
+
+		if err := script.Verify(in.Script, locking, checker); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-		r := big.Int{}
-		s := big.Int{}
+// Checks signatures and lock times for the scripts of one input
+type txChecker struct {
+	tx            *Transaction
+	index         int
+	lockingScript []byte
+	height        int
+	medianTime    int64
+}
 
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
+func (c *txChecker) CheckSig(sig, pubKey []byte) bool {
+	if c.tx.Version < ScriptTxVersion {
+		sig = legacySignature(sig)
+	}
 
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
+	return wallet.VerifySignature(pubKey, c.tx.SignatureHash(c.index, c.lockingScript), sig)
+}
 
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
+func (c *txChecker) CheckLockTime(lockTime int64) bool {
+	if lockTime < script.LockTimeThreshold {
+		return int64(c.height) >= lockTime
+	}
 
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
-			return false
-		}
-		txCopy.Inputs[inId].PubKey = nil
+	return c.medianTime >= lockTime
+}
+
+// The relative lock time of the input itself is enforced by the sequence locks of the block
+func (c *txChecker) CheckSequence(sequence int64) bool {
+	txSequence := int64(c.tx.Inputs[c.index].Sequence)
+
+	if c.tx.Version < LockTimeVersion || txSequence&script.SequenceDisableFlag != 0 {
+		return false
 	}
 
-	return true
+	mask := int64(script.SequenceTypeFlag | script.SequenceMask)
+	sequence &= mask
+	txSequence &= mask
+
+	// Blocks cannot be compared with seconds
+	if (sequence&script.SequenceTypeFlag == 0) != (txSequence&script.SequenceTypeFlag == 0) {
+		return false
+	}
+
+	return sequence <= txSequence
 }
 
+// Version 1 signatures are r and s without leading zero bytes, split in the middle.
+// Returns the signature with r and s padded to 32 bytes each
+func legacySignature(sig []byte) []byte {
+	r := new(big.Int).SetBytes(sig[:len(sig)/2])
+	s := new(big.Int).SetBytes(sig[len(sig)/2:])
+	if r.BitLen() > 256 || s.BitLen() > 256 {
+		return nil
+	}
+
+	padded := make([]byte, 64)
+	r.FillBytes(padded[:32])
+	s.FillBytes(padded[32:])
+
+	return padded
+}
+
+// Returns a copy of the transaction without unlocking scripts
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{out.Value, out.Script})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, tx.Version, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
@@ -216,18 +372,27 @@ func (tx Transaction) String() string {
 	var lines []string
 
 	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("     Lock time: %d", tx.LockTime))
+	}
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		if tx.IsCoinbase() {
+			lines = append(lines, fmt.Sprintf("       Data:      %x", input.Script))
+		} else {
+			lines = append(lines, fmt.Sprintf("       Script:    %s", script.Disassemble(input.Script)))
+		}
+		if input.Sequence != script.MaxSequence {
+			lines = append(lines, fmt.Sprintf("       Sequence:  %08x", input.Sequence))
+		}
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       Script: %s", script.Disassemble(output.Script)))
 	}
 
 	return strings.Join(lines, "\n")
@@ -0,0 +1,116 @@
+package blockchain
+
+import (
+	"blockchain/main/script"
+	"blockchain/main/wallet"
+	"bytes"
+	"crypto/elliptic"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestReencodedSignatureKeepsID(t *testing.T) {
+	chain, w, first := newTestChain(t)
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(15, string(wallet.MakeWallet().Address())))
+	ID := tx.ID
+	encoded := tx.Serialize()
+
+	// (r, N-s) is as valid a signature as (r, s)
+	pushes, ok := script.ExtractPushes(tx.Inputs[0].Script)
+	if ok == false || len(pushes) != 2 {
+		t.Fatal("unexpected unlocking script")
+	}
+	sig := append([]byte{}, pushes[0]...)
+	s := new(big.Int).SetBytes(sig[32:])
+	s.Sub(elliptic.P256().Params().N, s)
+	s.FillBytes(sig[32:])
+	tx.Inputs[0].Script = script.PayToPubKeyHashUnlock(sig, pushes[1])
+
+	if bytes.Equal(tx.Serialize(), encoded) {
+		t.Fatal("signature encoding did not change")
+	}
+	if chain.VerifyTransaction(tx) == false {
+		t.Fatal("re-encoded signature is not valid")
+	}
+	if bytes.Equal(tx.Hash(), ID) == false {
+		t.Fatal("re-encoding the signature changed the ID")
+	}
+}
+
+func TestCoinbaseIDCoversData(t *testing.T) {
+	a := CoinbaseTx(string(wallet.MakeWallet().Address()), "a", 1, 0)
+	b := *a
+	b.Inputs = []TxInput{{a.Inputs[0].ID, -1, []byte("b"), a.Inputs[0].Sequence}}
+
+	if bytes.Equal(a.Hash(), b.Hash()) {
+		t.Fatal("coinbases with different data share an ID")
+	}
+}
+
+func TestDataOutputCarryingValueIsRejected(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	address := string(w.Address())
+
+	data := NewTXDataOutput([]byte("anchor"))
+	data.Value = 5
+	tx := newTestSpend(chain, w, first.Transactions[0], *data, *NewTXOutput(15, address))
+
+	if tx.CheckDataOutputs() {
+		t.Fatal("data output carrying value is well formed")
+	}
+	if chain.VerifyTransaction(tx) {
+		t.Fatal("data output carrying value passed verification")
+	}
+
+	coinbase := CoinbaseTx(address, "", chain.GetBestHeight()+1, 0)
+	block := newTestBlock(t, chain, chain.LastHash, coinbase, tx)
+
+	if err := chain.AddBlock(block); errors.Is(err, ErrBadDataOutput) == false {
+		t.Fatalf("expected %v, got %v", ErrBadDataOutput, err)
+	}
+}
+
+func TestSubsidyHalves(t *testing.T) {
+	cases := map[int]int{
+		0:                         InitialSubsidy,
+		HalvingInterval - 1:       InitialSubsidy,
+		HalvingInterval:           InitialSubsidy / 2,
+		2*HalvingInterval - 1:     InitialSubsidy / 2,
+		2 * HalvingInterval:       InitialSubsidy / 4,
+		100 * HalvingInterval:     0,
+		1000000 * HalvingInterval: 0,
+	}
+	for height, subsidy := range cases {
+		if Subsidy(height) != subsidy {
+			t.Fatalf("height %d: expected %d, got %d", height, subsidy, Subsidy(height))
+		}
+	}
+
+	supply := 0
+	for height := 0; Subsidy(height) > 0; height++ {
+		supply += Subsidy(height)
+	}
+	if supply != MaxSupply() {
+		t.Fatalf("expected %d, got %d", supply, MaxSupply())
+	}
+}
+
+func TestCoinbaseMayClaimTheFees(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	to := string(wallet.MakeWallet().Address())
+	fee := Subsidy(first.Height) - 15
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(15, to))
+
+	greedy := CoinbaseTx(to, "", chain.GetBestHeight()+1, fee+1)
+	if err := chain.AddBlock(newTestBlock(t, chain, chain.LastHash, greedy, tx)); errors.Is(err, ErrBadValue) == false {
+		t.Fatalf("expected %v, got %v", ErrBadValue, err)
+	}
+
+	coinbase := CoinbaseTx(to, "", chain.GetBestHeight()+1, fee)
+	if err := chain.AddBlock(newTestBlock(t, chain, chain.LastHash, coinbase, tx)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,41 +1,78 @@
 package blockchain
 
 import (
+	"blockchain/main/script"
 	"blockchain/main/wallet"
 	"bytes"
-	"encoding/gob"
 )
 
+// Output locked by a script that the spending input's script must satisfy
 type TxOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value  int
+	Script []byte
 }
 
-type TxOutputs struct {
-	Outputs []TxOutput
+// Unspent output with the height of the block that created it
+type UTXOEntry struct {
+	Output   TxOutput
+	Height   int
+	Coinbase bool
 }
 
+// Input spending an output with a script that pushes what its locking script needs.
+// The coinbase input has no previous output and carries arbitrary data as its script.
+// Unless the sequence is script.MaxSequence the transaction lock time applies, and unless
+// it has script.SequenceDisableFlag set it holds a relative lock time
 type TxInput struct {
-	ID        []byte
-	Out       int
-	Signature []byte
-	PubKey    []byte
+	ID       []byte
+	Out      int
+	Script   []byte
+	Sequence uint32
 }
 
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey)
+	pubKey := script.ExtractPubKey(in.Script)
+	if pubKey == nil {
+		return false
+	}
 
-	return bytes.Compare(lockingHash, pubKeyHash) == 0
+	return bytes.Compare(wallet.PublicKeyHash(pubKey), pubKeyHash) == 0
 }
 
+// Locks the output to the pubkey hash or the redeem script hash of the address
 func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	hash, isScript := wallet.DecodeAddress(address)
+	if isScript {
+		out.Script = script.PayToScriptHash(hash)
+	} else {
+		out.Script = script.PayToPubKeyHash(hash)
+	}
+}
+
+// Returns the pubkey hash or the redeem script hash the output pays to,
+// nil if its script is not a standard payment to an address
+func (out *TxOutput) AddressHash() []byte {
+	if hash := script.ExtractPubKeyHash(out.Script); hash != nil {
+		return hash
+	}
+
+	return script.ExtractScriptHash(out.Script)
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	lockingHash := out.AddressHash()
+
+	return lockingHash != nil && bytes.Compare(lockingHash, pubKeyHash) == 0
+}
+
+// Reports whether the output carries data and can never be spent
+func (out *TxOutput) IsData() bool {
+	return script.IsUnspendable(out.Script)
+}
+
+// Creates an unspendable output carrying the data
+func NewTXDataOutput(data []byte) *TxOutput {
+	return &TxOutput{0, script.NullData(data)}
 }
 
 func NewTXOutput(value int, address string) *TxOutput {
@@ -45,18 +82,22 @@ func NewTXOutput(value int, address string) *TxOutput {
 	return txo
 }
 
-func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
-	Handle(err)
-	return buffer.Bytes()
+// Reports whether the output can be spent in a block of the given height
+func (entry UTXOEntry) IsMature(height int) bool {
+	return entry.Coinbase == false || height-entry.Height >= CoinbaseMaturity
+}
+
+func (entry UTXOEntry) Serialize() []byte {
+	var e encoder
+	entry.encode(&e)
+
+	return e.Bytes()
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
-	var outputs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outputs)
-	Handle(err)
-	return outputs
+func DeserializeEntry(data []byte) UTXOEntry {
+	d := &decoder{data: data}
+	entry := decodeEntry(d)
+	Handle(d.finish())
+
+	return entry
 }
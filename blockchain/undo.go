@@ -0,0 +1,107 @@
+package blockchain
+
+var (
+	// Block hash -> outputs spent by the block
+	undoPrefix = []byte("undo-")
+)
+
+// Output removed from the UTXO set by a block, kept so the block can be disconnected
+type SpentOutput struct {
+	TxID     []byte
+	Out      int
+	Output   TxOutput
+	Height   int
+	Coinbase bool
+}
+
+// Everything needed to revert the UTXO changes of a block
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func undoKey(blockHash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), blockHash...)
+}
+
+func (undo BlockUndo) Serialize() []byte {
+	var e encoder
+
+	e.writeUint32(uint32(len(undo.Spent)))
+	for _, spent := range undo.Spent {
+		e.writeBytes(spent.TxID)
+		e.writeInt64(int64(spent.Out))
+
+		entry := UTXOEntry{spent.Output, spent.Height, spent.Coinbase}
+		entry.encode(&e)
+	}
+
+	return e.Bytes()
+}
+
+func DeserializeUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+	d := &decoder{data: data}
+
+	// A spent output takes at least 29 bytes
+	count := d.readCount(29)
+	for i := 0; i < count; i++ {
+		txID := d.readBytes()
+		out := int(d.readInt64())
+		entry := decodeEntry(d)
+
+		undo.Spent = append(undo.Spent, SpentOutput{txID, out, entry.Output, entry.Height, entry.Coinbase})
+	}
+	Handle(d.finish())
+
+	return undo
+}
+
+// Rebuilds the undo data of every main chain block from the outputs its transactions spend.
+// The transaction index must be up to date. An interrupted rebuild continues where it stopped
+func (chain *BlockChain) ReindexUndo() {
+	next := chain.resumeRebuild(undoRebuildKey)
+	if next == nil {
+		next = chain.LastHash
+	}
+
+	batch := newChunkedBatch(chain.Database)
+	iter := &ChainIterator{next, chain.Database}
+
+	for {
+		block := iter.Next()
+		undo := BlockUndo{}
+
+		for _, tx := range block.Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+
+			for _, in := range tx.Inputs {
+				prevTX, prevBlock, err := chain.lookupTransaction(chain.Database, in.ID)
+				Handle(err)
+
+				spent := SpentOutput{in.ID, in.Out, prevTX.Outputs[in.Out], prevBlock.Height, prevTX.IsCoinbase()}
+				undo.Spent = append(undo.Spent, spent)
+			}
+		}
+
+		err := batch.Update(undoKey(block.Hash), undo.Serialize())
+		Handle(err)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+
+		err = chain.saveRebuild(batch, undoRebuildKey, block.PrevHash)
+		Handle(err)
+
+		err = batch.checkpoint()
+		Handle(err)
+	}
+
+	err := batch.Delete(undoRebuildKey)
+	Handle(err)
+
+	err = batch.Write()
+	Handle(err)
+}
@@ -1,265 +1,332 @@
 package blockchain
 
 import (
+	"blockchain/main/database"
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
-	"github.com/dgraph-io/badger"
-	"log"
 )
 
 var (
 	utxoPrefix = []byte("utxo-")
+
+	// Address hash and UTXO outpoint -> nothing, so the outputs of an address can be found without a full scan
+	addrUTXOPrefix = []byte("addr-")
+
+	// Number of blocks a coinbase output must be buried under before it can be spent
+	CoinbaseMaturity = 10
 )
 
 type UTXOSet struct {
 	BlockChain *BlockChain
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOuts := make(map[string][]int)
-	accumulated := 0
+// Each unspent output is stored under the ID of its transaction followed by its index
+func utxoKey(txID []byte, out int) []byte {
+	key := append(append([]byte{}, utxoPrefix...), txID...)
 
-	err := u.BlockChain.Database.DB.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
+	return append(key, ToHex(int64(out))...)
+}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
+// Splits a UTXO set key into the transaction ID and the output index
+func parseUTXOKey(key []byte) ([]byte, int) {
+	key = bytes.TrimPrefix(key, utxoPrefix)
 
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
+	return key[:len(key)-8], int(binary.BigEndian.Uint64(key[len(key)-8:]))
+}
 
-			err := item.Value(func(val []byte) error {
-				outs := DeserializeOutputs(val)
+// Prefix of the address index keys of the outputs locked to the pubkey hash.
+// The length byte keeps a hash from matching a longer one it is a prefix of
+func addrUTXOKeyPrefix(pubKeyHash []byte) []byte {
+	prefix := append(append([]byte{}, addrUTXOPrefix...), byte(len(pubKeyHash)))
 
-				for outIdx, out := range outs.Outputs {
-					if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-						accumulated += out.Value
-						unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-					}
-				}
+	return append(prefix, pubKeyHash...)
+}
 
-				return nil
-			})
+func addrUTXOKey(pubKeyHash, txID []byte, out int) []byte {
+	key := append(addrUTXOKeyPrefix(pubKeyHash), txID...)
 
-			Handle(err)
-		}
+	return append(key, ToHex(int64(out))...)
+}
+
+// Adds the output to the UTXO set, and to the address index if it pays to an address.
+// Data outputs can never be spent and are not stored
+func putUnspent(batch database.Batch, txID []byte, out int, entry UTXOEntry) error {
+	if entry.Output.IsData() {
 		return nil
-	})
-	Handle(err)
-	return accumulated, unspentOuts
+	}
+
+	if err := batch.Update(utxoKey(txID, out), entry.Serialize()); err != nil {
+		return err
+	}
+
+	pubKeyHash := entry.Output.AddressHash()
+	if pubKeyHash == nil {
+		return nil
+	}
+
+	return batch.Update(addrUTXOKey(pubKeyHash, txID, out), []byte{})
 }
 
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
+// Removes the output from the UTXO set and the address index
+func deleteUnspent(batch database.Batch, txID []byte, out int, entry UTXOEntry) error {
+	if entry.Output.IsData() {
+		return nil
+	}
 
-	err := u.BlockChain.Database.DB.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	if err := batch.Delete(utxoKey(txID, out)); err != nil {
+		return err
+	}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+	pubKeyHash := entry.Output.AddressHash()
+	if pubKeyHash == nil {
+		return nil
+	}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			var v []byte
+	return batch.Delete(addrUTXOKey(pubKeyHash, txID, out))
+}
 
-			err := item.Value(func(val []byte) error {
-				v = val
-				return nil
-			})
-			Handle(err)
+// Calls fn for every unspent output locked to the pubkey hash, found through the address index
+func (u UTXOSet) forEachUnspent(pubKeyHash []byte, fn func(txID []byte, out int, entry UTXOEntry)) {
+	db := u.BlockChain.Database
+	prefix := addrUTXOKeyPrefix(pubKeyHash)
 
-			outs := DeserializeOutputs(v)
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
-			}
+	err := db.Iterate(prefix, func(key, _ []byte) error {
+		key = bytes.TrimPrefix(key, prefix)
+		txID, out := key[:len(key)-8], int(binary.BigEndian.Uint64(key[len(key)-8:]))
 
+		entry, err := findUnspent(db, txID, out)
+		if err != nil {
+			return err
 		}
+		if entry != nil {
+			fn(txID, out, *entry)
+		}
+
 		return nil
 	})
 	Handle(err)
+}
 
-	return UTXOs
+// Selects outputs worth at least amount that can be spent in the next block.
+// Coinbase outputs are skipped until they are mature
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+	unspentOuts := make(map[string][]int)
+	accumulated := 0
+	height := u.BlockChain.GetBestHeight() + 1
+
+	u.forEachUnspent(pubKeyHash, func(txID []byte, outIdx int, entry UTXOEntry) {
+		if entry.IsMature(height) && accumulated < amount {
+			accumulated += entry.Output.Value
+			unspentOuts[hex.EncodeToString(txID)] = append(unspentOuts[hex.EncodeToString(txID)], outIdx)
+		}
+	})
+
+	return accumulated, unspentOuts
 }
 
-func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TxOutput {
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 	var UTXOs []TxOutput
 
-	db := u.BlockChain.Database
+	u.forEachUnspent(pubKeyHash, func(_ []byte, _ int, entry UTXOEntry) {
+		UTXOs = append(UTXOs, entry.Output)
+	})
 
-	err := db.DB.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	return UTXOs
+}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TxOutput {
+	return u.FindUnspentTransactions(pubKeyHash)
+}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
+// Returns the UTXO entry of the given output if it is still unspent, nil otherwise
+func findUnspent(r reader, txID []byte, out int) (*UTXOEntry, error) {
+	val, err := r.Read(utxoKey(txID, out))
+	if err == database.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-			err := item.Value(func(val []byte) error {
-				outs := DeserializeOutputs(val)
+	entry := DeserializeEntry(val)
 
-				for _, out := range outs.Outputs {
-					if out.IsLockedWithKey(pubKeyHash) {
-						UTXOs = append(UTXOs, out)
-					}
-				}
+	return &entry, nil
+}
 
-				return nil
-			})
+// Returns the number of coins in circulation, the sum of all unspent outputs
+func (u UTXOSet) TotalSupply() int {
+	db := u.BlockChain.Database
+	supply := 0
 
-			Handle(err)
-		}
+	err := db.Iterate(utxoPrefix, func(_, val []byte) error {
+		supply += DeserializeEntry(val).Output.Value
 
 		return nil
 	})
 	Handle(err)
 
-	return UTXOs
+	return supply
 }
 
+// Returns the number of transactions with at least one unspent output
 func (u UTXOSet) CountTransactions() int {
 	db := u.BlockChain.Database
-	counter := 0
+	transactions := make(map[string]bool)
 
-	err := db.Iterator(true, func(it *badger.Iterator) error {
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			counter++
-		}
+	err := db.Iterate(utxoPrefix, func(key, _ []byte) error {
+		txID, _ := parseUTXOKey(key)
+		transactions[string(txID)] = true
 
 		return nil
 	})
 
 	Handle(err)
 
-	return counter
+	return len(transactions)
 }
 
+// Rebuilds the UTXO set and the undo data by connecting the main chain blocks from the genesis on.
+// The height index must be up to date. An interrupted rebuild continues where it stopped
 func (u UTXOSet) Reindex() {
-	db := u.BlockChain.Database
+	chain := u.BlockChain
+	db := chain.Database
+	height := 0
 
-	u.DeleteByPrefix(utxoPrefix)
+	tip, err := chain.GetBlockHeader(chain.LastHash)
+	Handle(err)
 
-	UTXO := u.BlockChain.FindUTXO()
+	if last := chain.resumeRebuild(utxoRebuildKey); last != nil {
+		block, err := chain.GetBlockHeader(last)
+		Handle(err)
+		height = block.Height + 1
+	} else {
+		// The UTXO set no longer matches any block until the rebuild is done
+		err := db.Delete(utxoTipKey)
+		Handle(err)
+
+		deleteByPrefix(db, utxoPrefix)
+		deleteByPrefix(db, addrUTXOPrefix)
+	}
 
-	err := db.DB.Update(func(txn *badger.Txn) error {
-		for txId, outs := range UTXO {
-			key, err := hex.DecodeString(txId)
-			if err != nil {
-				return err
-			}
-			key = append(utxoPrefix, key...)
+	batch := newChunkedBatch(db)
 
-			err = txn.Set(key, outs.Serialize())
-			Handle(err)
-		}
+	for ; height <= tip.Height; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		Handle(err)
 
-		return nil
-	})
+		err = u.ConnectBlock(batch, &block)
+		Handle(err)
+
+		err = chain.saveRebuild(batch, utxoRebuildKey, block.Hash)
+		Handle(err)
+
+		err = batch.checkpoint()
+		Handle(err)
+	}
+
+	err = batch.Update(utxoTipKey, chain.LastHash)
+	Handle(err)
+
+	err = setStateVersion(batch)
+	Handle(err)
+
+	err = batch.Delete(utxoRebuildKey)
+	Handle(err)
+
+	err = batch.Write()
 	Handle(err)
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	db := u.BlockChain.Database
+// Applies the outputs created and spent by the block to the batch.
+// The spent outputs are saved as the block's undo data
+func (u *UTXOSet) ConnectBlock(batch database.Batch, block *Block) error {
+	undo := BlockUndo{}
 
-	err := db.DB.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					Handle(err)
-
-					err = item.Value(func(val []byte) error {
-						outs := DeserializeOutputs(val)
-
-						for outIdx, out := range outs.Outputs {
-							if outIdx != in.Out {
-								updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-							}
-						}
-
-						if len(updatedOuts.Outputs) == 0 {
-							if err := txn.Delete(inID); err != nil {
-								log.Panic(err)
-							}
-
-						} else {
-							if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-								log.Panic(err)
-							}
-						}
-
-						return nil
-					})
-
-					Handle(err)
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				entry, err := findUnspent(batch, in.ID, in.Out)
+				if err != nil {
+					return err
+				}
+				if entry == nil {
+					return ErrMissingInput
 				}
-			}
 
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+				undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, entry.Output, entry.Height, entry.Coinbase})
+
+				if err := deleteUnspent(batch, in.ID, in.Out, *entry); err != nil {
+					return err
+				}
 			}
+		}
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+		for outIdx, out := range tx.Outputs {
+			entry := UTXOEntry{out, block.Height, tx.IsCoinbase()}
+			if err := putUnspent(batch, tx.ID, outIdx, entry); err != nil {
+				return err
 			}
 		}
+	}
 
-		return nil
-	})
-	Handle(err)
+	return batch.Update(undoKey(block.Hash), undo.Serialize())
 }
 
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
-	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.BlockChain.Database.DB.Update(func(txn *badger.Txn) error {
-			for _, key := range keysForDelete {
-				if err := txn.Delete(key); err != nil {
-					return err
-				}
+// Reverts the block in the batch. Outputs created by the block are removed
+// and the outputs it spent are restored from its undo data
+func (u *UTXOSet) DisconnectBlock(batch database.Batch, block *Block) error {
+	data, err := batch.Read(undoKey(block.Hash))
+	if err != nil {
+		return err
+	}
+	undo := DeserializeUndo(data)
+
+	for _, tx := range block.Transactions {
+		for outIdx, out := range tx.Outputs {
+			entry := UTXOEntry{Output: out}
+			if err := deleteUnspent(batch, tx.ID, outIdx, entry); err != nil {
+				return err
 			}
-			return nil
-		}); err != nil {
-			return err
 		}
-
-		return nil
 	}
 
-	collectSize := 100000
+	created := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		created[hex.EncodeToString(tx.ID)] = true
+	}
 
-	err := u.BlockChain.Database.Iterator(false, func(it *badger.Iterator) error {
-		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
+	for _, spent := range undo.Spent {
+		// Outputs created and spent by the block itself are already gone
+		if created[hex.EncodeToString(spent.TxID)] {
+			continue
+		}
 
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
-				keysForDelete = make([][]byte, 0, collectSize)
-				keysCollected = 0
-			}
+		entry := UTXOEntry{spent.Output, spent.Height, spent.Coinbase}
+		if err := putUnspent(batch, spent.TxID, spent.Out, entry); err != nil {
+			return err
 		}
+	}
 
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
-			}
+	return batch.Delete(undoKey(block.Hash))
+}
+
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
+	deleteByPrefix(u.BlockChain.Database, prefix)
+}
+
+func deleteByPrefix(db database.Database, prefix []byte) {
+	batch := newChunkedBatch(db)
+
+	err := db.Iterate(prefix, func(key, _ []byte) error {
+		if err := batch.Delete(key); err != nil {
+			return err
 		}
 
-		return nil
+		return batch.checkpoint()
 	})
+	Handle(err)
 
+	err = batch.Write()
 	Handle(err)
 }
@@ -0,0 +1,377 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"blockchain/main/database"
+)
+
+// How far a block timestamp may be ahead of the adjusted network time
+const maxFutureBlockTime = 2 * 60 * 60
+
+// Consensus rules a block or transaction can break
+var (
+	ErrBadProofOfWork    = errors.New("proof of work is not valid")
+	ErrBadDifficulty     = errors.New("block does not commit to the expected target")
+	ErrBadHash           = errors.New("block hash does not match its contents")
+	ErrBadMerkleRoot     = errors.New("merkle root does not match the transactions")
+	ErrUnknownParent     = errors.New("previous block is not known")
+	ErrBadHeight         = errors.New("block height does not follow its parent")
+	ErrTimeTooOld        = errors.New("block timestamp is not after the median time past")
+	ErrTimeTooNew        = errors.New("block timestamp is too far in the future")
+	ErrNoTransactions    = errors.New("block has no transactions")
+	ErrBadCoinbase       = errors.New("block must start with exactly one coinbase")
+	ErrBadTxID           = errors.New("transaction ID does not match its contents")
+	ErrDuplicateTx       = errors.New("block contains a transaction more than once")
+	ErrTxExists          = errors.New("transaction ID is already in the chain")
+	ErrBadCoinbaseHeight = errors.New("coinbase does not start with the block height")
+	ErrBadVersion        = errors.New("block version is lower than its parent's")
+	ErrDoubleSpend       = errors.New("output is spent more than once")
+	ErrMissingInput      = errors.New("input refers to an unknown or spent output")
+	ErrImmatureSpend     = errors.New("coinbase output is spent before it is mature")
+	ErrBadScript         = errors.New("input script does not unlock the spent output")
+	ErrNotFinal          = errors.New("transaction lock time has not been reached")
+	ErrSequenceLocked    = errors.New("input relative lock time has not been reached")
+	ErrBadValue          = errors.New("output values do not add up")
+	ErrBadDataOutput     = errors.New("data output is malformed, too large or carries value")
+)
+
+// Returned when a block breaks a consensus rule. Err is one of the rule errors above
+type ValidationError struct {
+	Hash []byte
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("block %x rejected: %s", e.Hash, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func ruleError(block *Block, err error) error {
+	return &ValidationError{block.Hash, err}
+}
+
+// Checks the proof of work of a header, without its transactions
+func CheckHeader(header *BlockHeader) error {
+	if NewProof(header).Validate() == false {
+		return &ValidationError{header.Hash(), ErrBadProofOfWork}
+	}
+
+	return nil
+}
+
+// Checks the rules that do not depend on the rest of the chain
+func CheckBlock(block *Block) error {
+	// Stated hash must be the hash of the header
+	if bytes.Compare(block.BlockHeader.Hash(), block.Hash) != 0 {
+		return ruleError(block, ErrBadHash)
+	}
+
+	if err := CheckHeader(&block.BlockHeader); err != nil {
+		return err
+	}
+
+	if len(block.Transactions) == 0 {
+		return ruleError(block, ErrNoTransactions)
+	}
+
+	// The header must commit to exactly these transactions
+	if bytes.Compare(block.HashTransactions(), block.MerkleRoot) != 0 {
+		return ruleError(block, ErrBadMerkleRoot)
+	}
+
+	// Only the first transaction may be a coinbase
+	for i, tx := range block.Transactions {
+		if tx.IsCoinbase() != (i == 0) {
+			return ruleError(block, ErrBadCoinbase)
+		}
+	}
+
+	// Committing to the height keeps the coinbase ID unique
+	if block.Version >= CoinbaseHeightVersion && block.Transactions[0].HasCoinbaseHeight(block.Height) == false {
+		return ruleError(block, ErrBadCoinbaseHeight)
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.CheckID() == false {
+			return ruleError(block, ErrBadTxID)
+		}
+	}
+
+	// A repeated transaction leaves the Merkle root unchanged when it pads an odd level
+	seen := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if seen[string(tx.ID)] {
+			return ruleError(block, ErrDuplicateTx)
+		}
+		seen[string(tx.ID)] = true
+	}
+
+	// No output may be spent twice inside the block
+	spent := make(map[string]bool)
+	for _, tx := range block.Transactions[1:] {
+		for _, in := range tx.Inputs {
+			outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+			if spent[outpoint] {
+				return ruleError(block, ErrDoubleSpend)
+			}
+			spent[outpoint] = true
+		}
+	}
+
+	return nil
+}
+
+// Checks the block on its own and against its parent. The parent must already be stored
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	if err := CheckBlock(block); err != nil {
+		return err
+	}
+
+	if _, err := chain.Database.Read(block.PrevHash); err != nil {
+		return ruleError(block, ErrUnknownParent)
+	}
+
+	parent, err := chain.GetBlockHeader(block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	if block.Height != parent.Height+1 {
+		return ruleError(block, ErrBadHeight)
+	}
+
+	// Once a block uses a newer version, the rules of that version apply to its descendants
+	if block.Version < parent.Version {
+		return ruleError(block, ErrBadVersion)
+	}
+
+	bits, err := chain.NextBits(&parent)
+	if err != nil {
+		return err
+	}
+
+	if block.Bits != bits {
+		return ruleError(block, ErrBadDifficulty)
+	}
+
+	medianTime, err := chain.MedianTimePast(&parent)
+	if err != nil {
+		return err
+	}
+
+	if block.Timestamp <= medianTime {
+		return ruleError(block, ErrTimeTooOld)
+	}
+
+	if block.Timestamp > AdjustedTime()+maxFutureBlockTime {
+		return ruleError(block, ErrTimeTooNew)
+	}
+
+	return nil
+}
+
+// Checks the block transactions against the UTXO set seen through the batch.
+// The UTXO set must be at the state of the block's parent
+func (chain *BlockChain) checkBlockInputs(batch database.Batch, block *Block) error {
+	// Transactions created earlier in the same block can be spent by later ones
+	created := make(map[string]Transaction)
+	fees := 0
+
+	// Time locks are checked against the median time past of the parent
+	var parent BlockHeader
+	var medianTime int64
+	if len(block.PrevHash) > 0 {
+		var err error
+		parent, err = chain.GetBlockHeader(block.PrevHash)
+		if err != nil {
+			return err
+		}
+
+		medianTime, err = chain.MedianTimePast(&parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		exists, err := transactionExists(batch, tx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ruleError(block, ErrTxExists)
+		}
+
+		if _, ok := totalValue(tx.Outputs); ok == false {
+			return ruleError(block, ErrBadValue)
+		}
+
+		if tx.CheckDataOutputs() == false {
+			return ruleError(block, ErrBadDataOutput)
+		}
+
+		if tx.IsFinal(block.Height, medianTime) == false {
+			return ruleError(block, ErrNotFinal)
+		}
+
+		if tx.IsCoinbase() {
+			created[hex.EncodeToString(tx.ID)] = *tx
+			continue
+		}
+
+		prevTXs := make(map[string]Transaction)
+		inputValue := 0
+
+		// Heights of the blocks that created the spent outputs
+		var coinHeights []int
+
+		for _, in := range tx.Inputs {
+			prevTX, inBlock := created[hex.EncodeToString(in.ID)]
+			if inBlock == false {
+				var err error
+				prevTX, _, err = chain.lookupTransaction(batch, in.ID)
+				if err != nil {
+					return ruleError(block, ErrMissingInput)
+				}
+			}
+
+			if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+				return ruleError(block, ErrMissingInput)
+			}
+
+			if inBlock && prevTX.IsCoinbase() {
+				return ruleError(block, ErrImmatureSpend)
+			}
+
+			if inBlock == false {
+				entry, err := findUnspent(batch, in.ID, in.Out)
+				if err != nil {
+					return err
+				}
+				if entry == nil {
+					return ruleError(block, ErrMissingInput)
+				}
+				if entry.IsMature(block.Height) == false {
+					return ruleError(block, ErrImmatureSpend)
+				}
+				coinHeights = append(coinHeights, entry.Height)
+			} else {
+				coinHeights = append(coinHeights, block.Height)
+			}
+
+			var ok bool
+			inputValue, ok = addValues(inputValue, prevTX.Outputs[in.Out].Value)
+			if ok == false {
+				return ruleError(block, ErrBadValue)
+			}
+			prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		}
+
+		unlocked, err := chain.checkSequenceLocks(tx, coinHeights, &parent)
+		if err != nil {
+			return err
+		}
+		if unlocked == false {
+			return ruleError(block, ErrSequenceLocked)
+		}
+
+		if err := tx.Verify(prevTXs, block.Height, medianTime); err != nil {
+			return ruleError(block, fmt.Errorf("%w: %s", ErrBadScript, err))
+		}
+
+		fee, err := transactionFee(tx, inputValue)
+		if err != nil {
+			return ruleError(block, err)
+		}
+
+		var ok bool
+		fees, ok = addValues(fees, fee)
+		if ok == false {
+			return ruleError(block, ErrBadValue)
+		}
+
+		created[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	// The coinbase may claim the subsidy and the fees of the block
+	reward, ok := addValues(Subsidy(block.Height), fees)
+	if ok == false {
+		return ruleError(block, ErrBadValue)
+	}
+
+	coinbaseValue, _ := totalValue(block.Transactions[0].Outputs)
+	if coinbaseValue > reward {
+		return ruleError(block, ErrBadValue)
+	}
+
+	return nil
+}
+
+// Reports whether the ID of the transaction is already indexed or has unspent outputs.
+// Connecting another transaction with that ID would overwrite them
+func transactionExists(batch database.Batch, tx *Transaction) (bool, error) {
+	_, err := batch.Read(txIndexKey(tx.ID))
+	if err == nil {
+		return true, nil
+	}
+	if err != database.ErrNotFound {
+		return false, err
+	}
+
+	for outIdx := range tx.Outputs {
+		entry, err := findUnspent(batch, tx.ID, outIdx)
+		if err != nil {
+			return false, err
+		}
+		if entry != nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Returns the sum of the amounts. Reports false if an amount or the sum is negative
+// or above MaxMoney, which also keeps the sum from overflowing
+func addValues(values ...int) (int, bool) {
+	total := 0
+	for _, value := range values {
+		if value < 0 || value > MaxMoney {
+			return 0, false
+		}
+
+		total += value
+		if total > MaxMoney {
+			return 0, false
+		}
+	}
+
+	return total, true
+}
+
+// Returns the value of the outputs, reporting false if it is not a valid amount
+func totalValue(outputs []TxOutput) (int, bool) {
+	var values []int
+	for _, out := range outputs {
+		values = append(values, out.Value)
+	}
+
+	return addValues(values...)
+}
+
+// Returns the fee of a transaction spending inputs of the given value, whatever its outputs leave over
+func transactionFee(tx *Transaction, inputValue int) (int, error) {
+	outputValue, ok := totalValue(tx.Outputs)
+	if ok == false || outputValue > inputValue {
+		return 0, ErrBadValue
+	}
+
+	return inputValue - outputValue, nil
+}
@@ -0,0 +1,229 @@
+package blockchain
+
+import (
+	"blockchain/main/database"
+	"blockchain/main/wallet"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+)
+
+// Creates a chain in memory whose first block after the genesis pays a mature coinbase to the wallet
+func newTestChain(t *testing.T) (*BlockChain, *wallet.Wallet, *Block) {
+	w := wallet.MakeWallet()
+	chain := NewBlockChain(database.NewMemoryDatabase(), string(w.Address()))
+
+	first := mineTestBlocks(chain, w, CoinbaseMaturity+1)[0]
+
+	return chain, w, first
+}
+
+// Mines blocks paying their coinbase to the wallet on top of the tip
+func mineTestBlocks(chain *BlockChain, w *wallet.Wallet, count int) []*Block {
+	var blocks []*Block
+	for i := 0; i < count; i++ {
+		coinbase := CoinbaseTx(string(w.Address()), "", chain.GetBestHeight()+1, 0)
+		blocks = append(blocks, chain.MineBlock([]*Transaction{coinbase}))
+	}
+
+	return blocks
+}
+
+// Mines a block of the transactions on top of the parent without checking them against the chain
+func newTestBlock(t *testing.T, chain *BlockChain, parentHash []byte, txs ...*Transaction) *Block {
+	parent, err := chain.GetBlockHeader(parentHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bits, err := chain.NextBits(&parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	medianTime, err := chain.MedianTimePast(&parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := AdjustedTime()
+	if timestamp <= medianTime {
+		timestamp = medianTime + 1
+	}
+
+	return CreateBlock(txs, parentHash, parent.Height+1, bits, timestamp)
+}
+
+// Creates a transaction spending the first output of prevTX into the outputs, signed by the wallet
+func newTestSpend(chain *BlockChain, w *wallet.Wallet, prevTX *Transaction, outputs ...TxOutput) *Transaction {
+	input := TxInput{prevTX.ID, 0, nil, inputSequence(0)}
+	tx := &Transaction{nil, TxVersion, []TxInput{input}, outputs, 0}
+	chain.SignTransaction(tx, w.PrivateKey)
+	tx.ID = tx.Hash()
+
+	return tx
+}
+
+func TestValidSpendIsConnected(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	to := string(wallet.MakeWallet().Address())
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(15, to))
+	if chain.VerifyTransaction(tx) == false {
+		t.Fatal("valid transaction rejected")
+	}
+
+	coinbase := CoinbaseTx(to, "", chain.GetBestHeight()+1, Subsidy(first.Height)-15)
+	block := newTestBlock(t, chain, chain.LastHash, coinbase, tx)
+
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(chain.LastHash, block.Hash) == false {
+		t.Fatal("block is not the tip")
+	}
+}
+
+func TestCoinbaseClaimingTooMuchIsRejected(t *testing.T) {
+	chain, w, _ := newTestChain(t)
+
+	coinbase := CoinbaseTx(string(w.Address()), "", chain.GetBestHeight()+1, 1)
+	block := newTestBlock(t, chain, chain.LastHash, coinbase)
+
+	if err := chain.AddBlock(block); errors.Is(err, ErrBadValue) == false {
+		t.Fatalf("expected %v, got %v", ErrBadValue, err)
+	}
+}
+
+func TestOverflowingOutputsAreRejected(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	address := string(w.Address())
+	lastHash := chain.LastHash
+	UTXO := UTXOSet{chain}
+	supply := UTXO.TotalSupply()
+
+	// Wrapping around, the outputs add up to less than the spent 20 coins
+	tx := newTestSpend(chain, w, first.Transactions[0],
+		*NewTXOutput(math.MaxInt64, address),
+		*NewTXOutput(math.MaxInt64, address),
+		*NewTXOutput(18, address))
+
+	if chain.VerifyTransaction(tx) {
+		t.Fatal("transaction creating coins passed verification")
+	}
+
+	coinbase := CoinbaseTx(address, "", chain.GetBestHeight()+1, 2)
+	block := newTestBlock(t, chain, chain.LastHash, coinbase, tx)
+
+	if err := chain.AddBlock(block); errors.Is(err, ErrBadValue) == false {
+		t.Fatalf("expected %v, got %v", ErrBadValue, err)
+	}
+	if bytes.Equal(chain.LastHash, lastHash) == false {
+		t.Fatal("tip moved to the invalid block")
+	}
+	if UTXO.TotalSupply() != supply {
+		t.Fatal("invalid block changed the UTXO set")
+	}
+}
+
+func TestOutputAboveMaxMoneyIsRejected(t *testing.T) {
+	chain, w, first := newTestChain(t)
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(MaxMoney+1, string(w.Address())))
+	if chain.VerifyTransaction(tx) {
+		t.Fatal("output above MaxMoney passed verification")
+	}
+
+	if _, err := chain.TransactionFee(tx); errors.Is(err, ErrBadValue) == false {
+		t.Fatalf("expected %v, got %v", ErrBadValue, err)
+	}
+}
+
+func TestAddValues(t *testing.T) {
+	if total, ok := addValues(1, 2, 3); ok == false || total != 6 {
+		t.Fatal("valid amounts not added", total, ok)
+	}
+
+	for _, values := range [][]int{{-1}, {MaxMoney + 1}, {MaxMoney, 1}, {math.MaxInt64, math.MaxInt64, 2}} {
+		if _, ok := addValues(values...); ok {
+			t.Fatal("invalid amounts accepted", values)
+		}
+	}
+}
+
+func TestUnknownInputIsNotValid(t *testing.T) {
+	chain, w, first := newTestChain(t)
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(15, string(w.Address())))
+	tx.Inputs[0].ID = bytes.Repeat([]byte{1}, 32)
+	tx.ID = tx.Hash()
+
+	if chain.VerifyTransaction(tx) {
+		t.Fatal("transaction spending an unknown output passed verification")
+	}
+	if err := chain.CheckLocks(tx); errors.Is(err, ErrMissingInput) == false {
+		t.Fatalf("expected %v, got %v", ErrMissingInput, err)
+	}
+}
+
+func TestCoinbaseWithoutHeightIsRejected(t *testing.T) {
+	chain, w, _ := newTestChain(t)
+
+	coinbase := CoinbaseTx(string(w.Address()), "dup", chain.GetBestHeight()+2, 0)
+	coinbase.Outputs[0].Value = Subsidy(chain.GetBestHeight() + 1)
+	coinbase.ID = coinbase.Hash()
+	block := newTestBlock(t, chain, chain.LastHash, coinbase)
+
+	if err := chain.AddBlock(block); errors.Is(err, ErrBadCoinbaseHeight) == false {
+		t.Fatalf("expected %v, got %v", ErrBadCoinbaseHeight, err)
+	}
+
+	height := chain.GetBestHeight()
+	if bytes.Equal(CoinbaseTx(string(w.Address()), "dup", height+1, 0).ID, CoinbaseTx(string(w.Address()), "dup", height+2, 0).ID) {
+		t.Fatal("coinbases of different heights have the same ID")
+	}
+}
+
+func TestTransactionInTheChainIsRejected(t *testing.T) {
+	chain, w, first := newTestChain(t)
+	to := string(wallet.MakeWallet().Address())
+
+	tx := newTestSpend(chain, w, first.Transactions[0], *NewTXOutput(20, to))
+	chain.MineBlock([]*Transaction{CoinbaseTx(to, "", chain.GetBestHeight()+1, 0), tx})
+
+	coinbase := CoinbaseTx(to, "", chain.GetBestHeight()+1, 0)
+	block := newTestBlock(t, chain, chain.LastHash, coinbase, tx)
+
+	if err := chain.AddBlock(block); errors.Is(err, ErrTxExists) == false {
+		t.Fatalf("expected %v, got %v", ErrTxExists, err)
+	}
+}
+
+func TestImmatureCoinbaseIsNotSpent(t *testing.T) {
+	chain, w, _ := newTestChain(t)
+	address := string(w.Address())
+
+	tip, err := chain.GetBlock(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	immature := tip.Transactions[0]
+
+	tx := newTestSpend(chain, w, immature, *NewTXOutput(15, address))
+	block := newTestBlock(t, chain, chain.LastHash, CoinbaseTx(address, "", chain.GetBestHeight()+1, 0), tx)
+	if err := chain.AddBlock(block); errors.Is(err, ErrImmatureSpend) == false {
+		t.Fatalf("expected %v, got %v", ErrImmatureSpend, err)
+	}
+
+	UTXO := UTXOSet{chain}
+	_, outputs := UTXO.FindSpendableOutputs(wallet.PublicKeyHash(w.PublicKey), math.MaxInt32)
+	if _, ok := outputs[hex.EncodeToString(immature.ID)]; ok {
+		t.Fatal("immature coinbase is offered for spending")
+	}
+	// The coinbases of the genesis block and of the two blocks after it are mature
+	if len(outputs) != 3 {
+		t.Fatal("expected only the mature coinbases", len(outputs))
+	}
+}
@@ -3,13 +3,20 @@ package cli
 import (
 	"blockchain/main/blockchain"
 	"blockchain/main/network"
+	"blockchain/main/script"
 	"blockchain/main/wallet"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Responsible for processing command line arguments
@@ -21,11 +28,21 @@ func (cli *CommandLine) printUsage() {
 	fmt.Println(" getbalance -address ADDRESS - get the balance for an address")
 	fmt.Println(" createblockchain -address ADDRESS creates a blockchain and sends genesis reward to address")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -data DATA -mine - Send amount of coins paying FEE to the miner, not before the LOCKTIME block height or unix time. -data anchors hex DATA on chain, -to and -amount may then be left out. Then -mine flag is set, mine off of this node")
+	fmt.Println(" finddata -prefix PREFIX - Lists the data anchored on chain starting with the hex PREFIX")
+	fmt.Println(" createmultisig -required M -keys KEY1,KEY2,... - Creates an address spendable with M signatures of the keys, given as wallet addresses or hex public keys")
+	fmt.Println(" cosign -tx TX -mine - Adds the signatures of our wallets to a multisig transaction and sends it once it is complete")
 	fmt.Println(" createwallet - Creates a new Wallet")
 	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" getsupply - Prints the number of coins issued so far")
+	fmt.Println(" gethistory -address ADDRESS -offset OFFSET -limit LIMIT - Lists the transactions that paid to or spent from an address")
+	fmt.Println(" gettxproof -txid TXID - Prints the Merkle proof that a transaction is included in its block")
+	fmt.Println(" initiatehtlc -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -secrethash HASH -mine - Locks amount in a contract TO redeems with the secret and FROM refunds from LOCKTIME on. Creates a secret unless HASH is given")
+	fmt.Println(" redeemhtlc -txid TXID -out OUT -secret SECRET -fee FEE -mine - Redeems a contract output with its secret")
+	fmt.Println(" refundhtlc -txid TXID -out OUT -fee FEE -mine - Refunds a contract output once its lock time has passed")
+	fmt.Println(" extractsecret -txid TXID -out OUT - Prints the secret revealed by the redeem of a contract output")
+	fmt.Println(" startnode -miner ADDRESS -workers N - Start a node with ID specified in NODE_ID env. var. -miner enables mining on N threads")
 }
 
 func (cli *CommandLine) validateArgs() {
@@ -36,7 +53,7 @@ func (cli *CommandLine) validateArgs() {
 }
 
 // Start node. If has miner address, start as miner
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
+func (cli *CommandLine) StartNode(nodeID, minerAddress string, workers int) {
 	fmt.Printf("Starting Node %s\n", nodeID)
 
 	if len(minerAddress) > 0 {
@@ -47,13 +64,13 @@ func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
 		}
 	}
 
-	network.StartServer(nodeID, minerAddress)
+	network.StartServer(nodeID, minerAddress, workers)
 }
 
 func (cli *CommandLine) reindexUTXO(nodeID string) {
 	chain := blockchain.ContinueBlockChain(nodeID)
 	defer func() {
-		err := chain.Database.DB.Close()
+		err := chain.Database.Close()
 		if err != nil {
 			log.Panic(err)
 		}
@@ -66,6 +83,87 @@ func (cli *CommandLine) reindexUTXO(nodeID string) {
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
+func (cli *CommandLine) getSupply(nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func() {
+		err := chain.Database.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	supply := UTXOSet.TotalSupply()
+
+	fmt.Printf("Issued: %d of %d\n", supply, blockchain.MaxSupply())
+	fmt.Printf("Next block subsidy: %d\n", blockchain.Subsidy(chain.GetBestHeight()+1))
+}
+
+func (cli *CommandLine) getHistory(address string, offset, limit int, nodeID string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("Address is not Valid")
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func() {
+		err := chain.Database.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	if !chain.HasAddressHistory() {
+		fmt.Println("Building address history index..")
+		chain.EnableAddressHistory()
+	}
+
+	pubKeyHash := wallet.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+
+	entries, err := chain.GetHistory(pubKeyHash, offset, limit)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%d %x %s %d\n", entry.Height, entry.TxID, entry.Direction, entry.Amount)
+	}
+}
+
+func (cli *CommandLine) getTxProof(txID, nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func() {
+		err := chain.Database.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	proof, err := chain.TransactionProof(ID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block: %x\n", proof.Header.Hash())
+	fmt.Printf("Height: %d\n", proof.Header.Height)
+	fmt.Printf("Header: %x\n", proof.Header.Serialize())
+	fmt.Printf("Transaction: %x\n", proof.Transaction)
+	fmt.Printf("Index: %d\n", proof.Index)
+	for _, step := range proof.Path {
+		side := "right"
+		if step.Left {
+			side = "left"
+		}
+		fmt.Printf("Sibling: %s %x\n", side, step.Hash)
+	}
+	fmt.Printf("Valid: %s\n", strconv.FormatBool(proof.Verify()))
+}
+
 func (cli *CommandLine) listAddresses(nodeID string) {
 	wallets, _ := wallet.CreateWallets(nodeID)
 	addresses := wallets.GetAllAddresses()
@@ -73,6 +171,269 @@ func (cli *CommandLine) listAddresses(nodeID string) {
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+
+	for address := range wallets.Scripts {
+		fmt.Printf("%s (multisig)\n", address)
+	}
+}
+
+// Creates the multisig redeem script and stores it so the address can be watched and spent from.
+// Every signer creates the address with the same keys in the same order
+func (cli *CommandLine) createMultisig(required int, keys []string, nodeID string) {
+	wallets, _ := wallet.CreateWallets(nodeID)
+
+	var pubKeys [][]byte
+	for _, key := range keys {
+		if w, ok := wallets.Wallets[key]; ok {
+			pubKeys = append(pubKeys, w.PublicKey)
+			continue
+		}
+
+		pubKey, err := hex.DecodeString(key)
+		if err != nil || len(pubKey) == 0 {
+			log.Panicf("Key %s is neither a wallet address nor a hex public key", key)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	if required < 1 || required > len(pubKeys) || len(pubKeys) > 16 {
+		log.Panic("Required signatures must be between 1 and the number of keys, at most 16")
+	}
+
+	redeemScript := script.Multisig(required, pubKeys)
+	if len(redeemScript) > script.MaxElementSize {
+		log.Panic("Too many keys for a redeem script")
+	}
+
+	address := wallets.AddScript(redeemScript)
+	wallets.SaveFile(nodeID)
+
+	fmt.Printf("New multisig address is: %s\n", address)
+	fmt.Printf("Redeem script: %x\n", redeemScript)
+}
+
+// Signs a transaction spending from a multisig address with every wallet holding one of its keys.
+// The transaction is sent once it has all signatures, otherwise it is printed for the next signer
+func (cli *CommandLine) cosign(txHex string, nodeID string, mineNow bool) {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	tx, err := blockchain.DecodeTransaction(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func() {
+		err := chain.Database.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	signer := cli.signMultisig(chain, &tx, wallets)
+	if signer == "" {
+		log.Panic("None of our wallets can sign this transaction")
+	}
+
+	cli.sendMultisig(chain, &tx, signer, mineNow)
+}
+
+// Adds the signatures of every wallet holding a key of the redeem scripts of the inputs.
+// Returns the address of a wallet that signed, empty if none did
+func (cli *CommandLine) signMultisig(chain *blockchain.BlockChain, tx *blockchain.Transaction, wallets *wallet.Wallets) string {
+	signer := ""
+
+	for _, in := range tx.Inputs {
+		redeemScript := blockchain.MultisigRedeemScript(in.Script)
+		_, keys, ok := script.ExtractMultisig(redeemScript)
+		if ok == false {
+			continue
+		}
+
+		for _, key := range keys {
+			w := wallets.FindWallet(key)
+			if w != nil && chain.SignMultisigTransaction(tx, w.PrivateKey, redeemScript) > 0 {
+				signer = fmt.Sprintf("%s", w.Address())
+			}
+		}
+	}
+
+	return signer
+}
+
+// Sends the multisig transaction if it has all signatures, otherwise prints it for the next signer
+func (cli *CommandLine) sendMultisig(chain *blockchain.BlockChain, tx *blockchain.Transaction, minerAddress string, mineNow bool) {
+	if missing := chain.MissingSignatures(tx); missing > 0 {
+		fmt.Printf("Transaction needs %d more signatures. Pass it to the other signers with cosign:\n", missing)
+		fmt.Printf("%x\n", tx.Serialize())
+		return
+	}
+
+	cli.submit(chain, tx, minerAddress, mineNow)
+}
+
+// Mines the transaction on this node, rewarding the miner address, or sends it to the network
+func (cli *CommandLine) submit(chain *blockchain.BlockChain, tx *blockchain.Transaction, minerAddress string, mineNow bool) {
+	if mineNow {
+		// A locked transaction cannot be mined before its lock times pass
+		if err := chain.CheckLocks(tx); err != nil {
+			log.Panic(err)
+		}
+		fee, err := chain.TransactionFee(tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		cbTx := blockchain.CoinbaseTx(minerAddress, "", chain.GetBestHeight()+1, fee)
+		txs := []*blockchain.Transaction{cbTx, tx}
+		chain.MineBlock(txs)
+	} else {
+		network.SendTx(network.KnownNodes[0], tx)
+	}
+
+	fmt.Println("Success!")
+}
+
+// Locks amount in a hash time-locked contract paying to the recipient. Unless the secret hash of the
+// other side of a swap is given, a new secret is created and printed
+func (cli *CommandLine) initiateHTLC(from, to string, amount, fee int, lockTime int64, secretHashHex, nodeID string, mineNow bool) {
+	if !wallet.ValidateAddress(to) || !wallet.ValidateAddress(from) {
+		log.Panic("Address is not Valid")
+	}
+
+	var secretHash []byte
+	if secretHashHex == "" {
+		secret := make([]byte, script.HTLCSecretSize)
+		_, err := rand.Read(secret)
+		if err != nil {
+			log.Panic(err)
+		}
+		hash := sha256.Sum256(secret)
+		secretHash = hash[:]
+
+		fmt.Printf("Secret: %x\n", secret)
+	} else {
+		var err error
+		secretHash, err = hex.DecodeString(secretHashHex)
+		if err != nil || len(secretHash) != sha256.Size {
+			log.Panic("Secret hash must be a hex encoded SHA-256 hash")
+		}
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{chain}
+	defer func() {
+		err := chain.Database.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wal := wallets.GetWallet(from)
+
+	tx := blockchain.NewHTLCTransaction(&wal, to, amount, fee, secretHash, lockTime, &UTXOSet)
+
+	fmt.Printf("Contract: %x output 0\n", tx.ID)
+	fmt.Printf("Secret hash: %x\n", secretHash)
+	fmt.Printf("Refund from: %d\n", lockTime)
+
+	cli.submit(chain, tx, from, mineNow)
+}
+
+// Spends a hash time-locked contract to the local wallet it pays to. A secret redeems it as the
+// recipient, an empty secret refunds it to the sender
+func (cli *CommandLine) spendHTLC(txID string, out int, secretHex string, fee int, nodeID string, mineNow bool) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var secret []byte
+	if secretHex != "" {
+		secret, err = hex.DecodeString(secretHex)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func() {
+		err := chain.Database.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	contractTx, err := chain.FindTransaction(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if out < 0 || out >= len(contractTx.Outputs) {
+		log.Panic(blockchain.ErrMissingInput)
+	}
+
+	_, recipientHash, _, refundHash, ok := script.ExtractHTLC(contractTx.Outputs[out].Script)
+	if ok == false {
+		log.Panic(blockchain.ErrNotHTLC)
+	}
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	party := refundHash
+	if secret != nil {
+		party = recipientHash
+	}
+
+	wal := wallets.FindWalletByHash(party)
+	if wal == nil {
+		log.Panic(blockchain.ErrNotParty)
+	}
+
+	tx, err := blockchain.NewHTLCSpend(wal, &contractTx, out, secret, fee)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	cli.submit(chain, tx, fmt.Sprintf("%s", wal.Address()), mineNow)
+}
+
+// Prints the secret revealed by the redeem of a hash time-locked contract
+func (cli *CommandLine) extractSecret(txID string, out int, nodeID string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func() {
+		err := chain.Database.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	secret, err := chain.FindHTLCSecret(id, out)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Secret: %x\n", secret)
 }
 
 func (cli *CommandLine) createWallet(nodeID string) {
@@ -86,7 +447,7 @@ func (cli *CommandLine) createWallet(nodeID string) {
 func (cli *CommandLine) printChain(nodeID string) {
 	chain := blockchain.ContinueBlockChain(nodeID)
 	defer func() {
-		err := chain.Database.DB.Close()
+		err := chain.Database.Close()
 		if err != nil {
 			log.Panic(err)
 		}
@@ -99,7 +460,8 @@ func (cli *CommandLine) printChain(nodeID string) {
 
 		fmt.Printf("Hash: %x\n", block.Hash)
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
-		pow := blockchain.NewProof(block)
+		fmt.Printf("Bits: %08x\n", block.Bits)
+		pow := blockchain.NewProof(&block.BlockHeader)
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
@@ -119,15 +481,12 @@ func (cli *CommandLine) createBlockChain(address, nodeID string) {
 
 	chain := blockchain.InitBlockChain(address, nodeID)
 	defer func() {
-		err := chain.Database.DB.Close()
+		err := chain.Database.Close()
 		if err != nil {
 			log.Panic(err)
 		}
 	}()
 
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
-
 	fmt.Println("Finished!")
 }
 
@@ -139,7 +498,7 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
 	chain := blockchain.ContinueBlockChain(nodeID)
 	UTXOSet := blockchain.UTXOSet{chain}
 	defer func() {
-		err := chain.Database.DB.Close()
+		err := chain.Database.Close()
 		if err != nil {
 			log.Panic(err)
 		}
@@ -157,8 +516,8 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
 	fmt.Printf("Balance of %s: %d\n", address, balance)
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
-	if !wallet.ValidateAddress(to) {
+func (cli *CommandLine) send(from, to string, amount, fee int, lockTime uint32, data []byte, nodeID string, mineNow bool) {
+	if to != "" && !wallet.ValidateAddress(to) {
 		log.Panic("Address is not Valid")
 	}
 
@@ -170,7 +529,7 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow
 
 	UTXOSet := blockchain.UTXOSet{chain}
 	defer func() {
-		err := chain.Database.DB.Close()
+		err := chain.Database.Close()
 		if err != nil {
 			log.Panic(err)
 		}
@@ -181,20 +540,52 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow
 		log.Panic(err)
 	}
 
-	wal := wallets.GetWallet(from)
+	// Spending from a multisig address needs the signatures of the other signers too
+	if redeemScript, ok := wallets.GetScript(from); ok {
+		if to == "" {
+			log.Panic("Sending from a multisig address needs a destination")
+		}
+		tx := blockchain.NewMultisigTransaction(redeemScript, to, amount, fee, lockTime, &UTXOSet)
+		if data != nil {
+			// Nothing is signed yet, so the data output can still be added
+			tx.Outputs = append(tx.Outputs, *blockchain.NewTXDataOutput(data))
+			tx.ID = tx.Hash()
+		}
+		cli.signMultisig(chain, tx, wallets)
+		cli.sendMultisig(chain, tx, from, mineNow)
+		return
+	}
 
-	tx := blockchain.NewTransaction(&wal, to, amount, &UTXOSet)
+	wal := wallets.GetWallet(from)
 
-	if mineNow {
-		cbTx := blockchain.CoinbaseTx(from, "")
-		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
+	var tx *blockchain.Transaction
+	if data != nil {
+		tx = blockchain.NewDataTransaction(&wal, to, amount, data, fee, lockTime, &UTXOSet)
 	} else {
-		network.SendTx(network.KnownNodes[0], tx)
+		tx = blockchain.NewTransaction(&wal, to, amount, fee, lockTime, &UTXOSet)
 	}
 
-	fmt.Println("Success!")
+	cli.submit(chain, tx, from, mineNow)
+}
+
+// Lists the data anchored on the main chain that starts with the prefix
+func (cli *CommandLine) findData(prefix []byte, nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer func() {
+		err := chain.Database.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	for _, record := range chain.FindData(prefix) {
+		fmt.Printf("Transaction: %x output %d\n", record.TxID, record.Out)
+		fmt.Printf("Block: %x\n", record.BlockHash)
+		fmt.Printf("Height: %d\n", record.Height)
+		fmt.Printf("Time: %s\n", time.Unix(record.Timestamp, 0).UTC().Format(time.RFC3339))
+		fmt.Printf("Data: %x\n", record.Data)
+		fmt.Println()
+	}
 }
 
 // Parse command line arguments and processes commands
@@ -210,10 +601,20 @@ func (cli *CommandLine) Run() {
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	findDataCmd := flag.NewFlagSet("finddata", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
+	getHistoryCmd := flag.NewFlagSet("gethistory", flag.ExitOnError)
+	getTxProofCmd := flag.NewFlagSet("gettxproof", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	cosignCmd := flag.NewFlagSet("cosign", flag.ExitOnError)
+	initiateHTLCCmd := flag.NewFlagSet("initiatehtlc", flag.ExitOnError)
+	redeemHTLCCmd := flag.NewFlagSet("redeemhtlc", flag.ExitOnError)
+	refundHTLCCmd := flag.NewFlagSet("refundhtlc", flag.ExitOnError)
+	extractSecretCmd := flag.NewFlagSet("extractsecret", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
@@ -221,8 +622,39 @@ func (cli *CommandLine) Run() {
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendLockTime := sendCmd.Uint("locktime", 0, "Block height, or unix time from 500000000 on, before which the transaction cannot be mined")
+	sendData := sendCmd.String("data", "", "Hex encoded data to anchor in an unspendable output")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	findDataPrefix := findDataCmd.String("prefix", "", "Hex encoded start of the data to find, all data when empty")
+	getHistoryAddress := getHistoryCmd.String("address", "", "The address to list transactions for")
+	getHistoryOffset := getHistoryCmd.Int("offset", 0, "Number of transactions to skip")
+	getHistoryLimit := getHistoryCmd.Int("limit", 20, "Number of transactions to list")
+	getTxProofID := getTxProofCmd.String("txid", "", "The transaction to prove")
+	createMultisigRequired := createMultisigCmd.Int("required", 0, "Number of signatures needed to spend")
+	createMultisigKeys := createMultisigCmd.String("keys", "", "Comma separated wallet addresses or hex public keys")
+	cosignTx := cosignCmd.String("tx", "", "Hex encoded transaction to sign")
+	cosignMine := cosignCmd.Bool("mine", false, "Mine immediately on the same node once complete")
+	initiateHTLCFrom := initiateHTLCCmd.String("from", "", "Wallet address funding the contract and taking refunds")
+	initiateHTLCTo := initiateHTLCCmd.String("to", "", "Wallet address redeeming the contract with the secret")
+	initiateHTLCAmount := initiateHTLCCmd.Int("amount", 0, "Amount to lock")
+	initiateHTLCFee := initiateHTLCCmd.Int("fee", 0, "Fee paid to the miner")
+	initiateHTLCLockTime := initiateHTLCCmd.Int64("locktime", 0, "Block height, or unix time from 500000000 on, from which the contract can be refunded")
+	initiateHTLCSecretHash := initiateHTLCCmd.String("secrethash", "", "Hex encoded SHA-256 hash of the secret of the other side of a swap")
+	initiateHTLCMine := initiateHTLCCmd.Bool("mine", false, "Mine immediately on the same node")
+	redeemHTLCTxID := redeemHTLCCmd.String("txid", "", "Transaction holding the contract")
+	redeemHTLCOut := redeemHTLCCmd.Int("out", 0, "Output index of the contract")
+	redeemHTLCSecret := redeemHTLCCmd.String("secret", "", "Hex encoded secret")
+	redeemHTLCFee := redeemHTLCCmd.Int("fee", 0, "Fee paid to the miner")
+	redeemHTLCMine := redeemHTLCCmd.Bool("mine", false, "Mine immediately on the same node")
+	refundHTLCTxID := refundHTLCCmd.String("txid", "", "Transaction holding the contract")
+	refundHTLCOut := refundHTLCCmd.Int("out", 0, "Output index of the contract")
+	refundHTLCFee := refundHTLCCmd.Int("fee", 0, "Fee paid to the miner")
+	refundHTLCMine := refundHTLCCmd.Bool("mine", false, "Mine immediately on the same node")
+	extractSecretTxID := extractSecretCmd.String("txid", "", "Transaction holding the contract")
+	extractSecretOut := extractSecretCmd.Int("out", 0, "Output index of the contract")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeWorkers := startNodeCmd.Int("workers", 0, "Number of mining threads, one per CPU when 0")
 
 	switch os.Args[1] {
 	case "reindexutxo":
@@ -230,6 +662,51 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getsupply":
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gethistory":
+		err := getHistoryCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettxproof":
+		err := getTxProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "cosign":
+		err := cosignCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "initiatehtlc":
+		err := initiateHTLCCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "redeemhtlc":
+		err := redeemHTLCCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "refundhtlc":
+		err := refundHTLCCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "extractsecret":
+		err := extractSecretCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -265,6 +742,11 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "finddata":
+		err := findDataCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		runtime.Goexit()
@@ -299,14 +781,104 @@ func (cli *CommandLine) Run() {
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO(nodeID)
 	}
+	if getSupplyCmd.Parsed() {
+		cli.getSupply(nodeID)
+	}
+
+	if getHistoryCmd.Parsed() {
+		if *getHistoryAddress == "" || *getHistoryOffset < 0 || *getHistoryLimit <= 0 {
+			getHistoryCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getHistory(*getHistoryAddress, *getHistoryOffset, *getHistoryLimit, nodeID)
+	}
+
+	if getTxProofCmd.Parsed() {
+		if *getTxProofID == "" {
+			getTxProofCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getTxProof(*getTxProofID, nodeID)
+	}
+
+	if createMultisigCmd.Parsed() {
+		if *createMultisigRequired <= 0 || *createMultisigKeys == "" {
+			createMultisigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createMultisig(*createMultisigRequired, strings.Split(*createMultisigKeys, ","), nodeID)
+	}
+
+	if cosignCmd.Parsed() {
+		if *cosignTx == "" {
+			cosignCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.cosign(*cosignTx, nodeID, *cosignMine)
+	}
+
+	if initiateHTLCCmd.Parsed() {
+		if *initiateHTLCFrom == "" || *initiateHTLCTo == "" || *initiateHTLCAmount <= 0 || *initiateHTLCFee < 0 ||
+			*initiateHTLCLockTime <= 0 || *initiateHTLCLockTime > math.MaxUint32 {
+			initiateHTLCCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.initiateHTLC(*initiateHTLCFrom, *initiateHTLCTo, *initiateHTLCAmount, *initiateHTLCFee, *initiateHTLCLockTime,
+			*initiateHTLCSecretHash, nodeID, *initiateHTLCMine)
+	}
+
+	if redeemHTLCCmd.Parsed() {
+		if *redeemHTLCTxID == "" || *redeemHTLCSecret == "" || *redeemHTLCFee < 0 {
+			redeemHTLCCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.spendHTLC(*redeemHTLCTxID, *redeemHTLCOut, *redeemHTLCSecret, *redeemHTLCFee, nodeID, *redeemHTLCMine)
+	}
+
+	if refundHTLCCmd.Parsed() {
+		if *refundHTLCTxID == "" || *refundHTLCFee < 0 {
+			refundHTLCCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.spendHTLC(*refundHTLCTxID, *refundHTLCOut, "", *refundHTLCFee, nodeID, *refundHTLCMine)
+	}
+
+	if extractSecretCmd.Parsed() {
+		if *extractSecretTxID == "" {
+			extractSecretCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.extractSecret(*extractSecretTxID, *extractSecretOut, nodeID)
+	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		// Without a destination the transaction only anchors data
+		payment := *sendTo != "" && *sendAmount > 0
+		if *sendFrom == "" || (payment == false && (*sendData == "" || *sendTo != "" || *sendAmount != 0)) ||
+			*sendFee < 0 || *sendLockTime > math.MaxUint32 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		var data []byte
+		if *sendData != "" {
+			var err error
+			data, err = hex.DecodeString(*sendData)
+			if err != nil || len(data) > script.MaxDataCarrierSize {
+				log.Panicf("Data must be hex encoded and at most %d bytes", script.MaxDataCarrierSize)
+			}
+		}
+
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, uint32(*sendLockTime), data, nodeID, *sendMine)
+	}
+
+	if findDataCmd.Parsed() {
+		prefix, err := hex.DecodeString(*findDataPrefix)
+		if err != nil {
+			findDataCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.findData(prefix, nodeID)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -315,6 +887,6 @@ func (cli *CommandLine) Run() {
 			startNodeCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.StartNode(nodeID, *startNodeMiner)
+		cli.StartNode(nodeID, *startNodeMiner, *startNodeWorkers)
 	}
 }
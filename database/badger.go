@@ -0,0 +1,132 @@
+package database
+
+import (
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Database stored on disk with badger
+type BadgerDatabase struct {
+	DB *badger.DB
+}
+
+func GetDatabase(dir string) (*BadgerDatabase, error) {
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = nil
+
+	if db, err := badger.Open(opts); err != nil {
+		if strings.Contains(err.Error(), "LOCK") {
+			if db, err := retry(dir, opts); err == nil {
+				log.Println("database unlocked, value log truncated")
+				return &BadgerDatabase{db}, nil
+			}
+			log.Println("could not unlock database:", err)
+		}
+		return nil, err
+	} else {
+		return &BadgerDatabase{db}, nil
+	}
+}
+
+func (db *BadgerDatabase) Read(key []byte) ([]byte, error) {
+	var value []byte
+
+	err := db.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+
+		if err != nil {
+			return err
+		}
+
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+
+	return value, err
+}
+
+func (db *BadgerDatabase) Update(key []byte, value []byte) error {
+	err := db.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+
+	return err
+}
+
+func (db *BadgerDatabase) Delete(key []byte) error {
+	err := db.DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+
+	return err
+}
+
+// Batches are committed in a single badger transaction so they are applied all or nothing
+func (db *BadgerDatabase) NewBatch() Batch {
+	return newBatch(db, func(changes map[string]change) error {
+		return db.DB.Update(func(txn *badger.Txn) error {
+			for key, c := range changes {
+				var err error
+				if c.deleted {
+					err = txn.Delete([]byte(key))
+				} else {
+					err = txn.Set([]byte(key), c.value)
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
+
+func (db *BadgerDatabase) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	err := db.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			if err := fn(item.KeyCopy(nil), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (db *BadgerDatabase) Close() error {
+	return db.DB.Close()
+}
+
+func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
+	lockPath := filepath.Join(dir, "LOCK")
+	if err := os.Remove(lockPath); err != nil {
+		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	}
+	retryOpts := originalOpts
+	retryOpts.Truncate = true
+	db, err := badger.Open(retryOpts)
+	return db, err
+}
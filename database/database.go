@@ -1,85 +1,83 @@
 package database
 
 import (
-	"fmt"
-	"github.com/dgraph-io/badger"
-	"log"
-	"os"
-	"path/filepath"
-	"strings"
+	"errors"
 )
 
-type Database struct {
-	DB *badger.DB
-}
+var ErrNotFound = errors.New("key not found")
 
-func GetDatabase(dir string) (*Database, error) {
-	opts := badger.DefaultOptions(dir)
-	opts.Logger = nil
-
-	if db, err := badger.Open(opts); err != nil {
-		if strings.Contains(err.Error(), "LOCK") {
-			if db, err := retry(dir, opts); err == nil {
-				log.Println("database unlocked, value log truncated")
-				return &Database{db}, nil
-			}
-			log.Println("could not unlock database:", err)
-		}
-		return nil, err
-	} else {
-		return &Database{db}, nil
-	}
-}
+// Key-value store the chain is kept in
+type Database interface {
+	// Returns the value of the key or ErrNotFound
+	Read(key []byte) ([]byte, error)
 
-func (db *Database) Iterator(prefetchValues bool, fn func(*badger.Iterator) error) error {
-	err := db.DB.View(func(txn *badger.Txn) error {
+	// Sets the value of the key
+	Update(key, value []byte) error
 
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = prefetchValues
-		it := txn.NewIterator(opts)
-		defer it.Close()
+	Delete(key []byte) error
 
-		return fn(it)
-	})
+	// Starts a set of changes that are written all at once
+	NewBatch() Batch
 
-	return err
+	// Calls fn for every key with the given prefix, in key order.
+	// Iteration stops at the first error fn returns
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+
+	Close() error
 }
 
-func (db *Database) Read(key []byte) ([]byte, error) {
-	var value []byte
+// Changes to a database that are applied atomically by Write.
+// Reads through a batch see its own pending changes
+type Batch interface {
+	Read(key []byte) ([]byte, error)
+	Update(key, value []byte) error
+	Delete(key []byte) error
+	Write() error
+}
 
-	err := db.DB.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
+// Pending change of a single key
+type change struct {
+	value   []byte
+	deleted bool
+}
 
-		if err != nil {
-			return err
-		}
+// Batch that keeps changes in memory and hands them to commit on Write
+type batch struct {
+	db      Database
+	changes map[string]change
+	commit  func(changes map[string]change) error
+}
 
-		value, err = item.ValueCopy(nil)
-		return err
-	})
+func newBatch(db Database, commit func(changes map[string]change) error) *batch {
+	return &batch{db, make(map[string]change), commit}
+}
 
-	return value, err
+func (b *batch) Read(key []byte) ([]byte, error) {
+	if c, ok := b.changes[string(key)]; ok {
+		if c.deleted {
+			return nil, ErrNotFound
+		}
+		return c.value, nil
+	}
+
+	return b.db.Read(key)
 }
 
-func (db *Database) Update(key []byte, value []byte) error {
+func (b *batch) Update(key, value []byte) error {
+	b.changes[string(key)] = change{append([]byte{}, value...), false}
 
-	fmt.Println("Add Key: " + string(key))
+	return nil
+}
 
-	err := db.DB.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, value)
-	})
+func (b *batch) Delete(key []byte) error {
+	b.changes[string(key)] = change{nil, true}
 
-	return err
+	return nil
 }
 
-func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
-	lockPath := filepath.Join(dir, "LOCK")
-	if err := os.Remove(lockPath); err != nil {
-		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
-	}
-	retryOpts := originalOpts
-	retryOpts.Truncate = true
-	db, err := badger.Open(retryOpts)
-	return db, err
+func (b *batch) Write() error {
+	err := b.commit(b.changes)
+	b.changes = make(map[string]change)
+
+	return err
 }
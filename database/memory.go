@@ -0,0 +1,94 @@
+package database
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// Database kept in memory, for tests and simulations that should not touch the disk
+type MemoryDatabase struct {
+	mutex  sync.RWMutex
+	values map[string][]byte
+}
+
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{values: make(map[string][]byte)}
+}
+
+func (db *MemoryDatabase) Read(key []byte) ([]byte, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	value, ok := db.values[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte{}, value...), nil
+}
+
+func (db *MemoryDatabase) Update(key, value []byte) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.values[string(key)] = append([]byte{}, value...)
+
+	return nil
+}
+
+func (db *MemoryDatabase) Delete(key []byte) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	delete(db.values, string(key))
+
+	return nil
+}
+
+func (db *MemoryDatabase) NewBatch() Batch {
+	return newBatch(db, func(changes map[string]change) error {
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+
+		for key, c := range changes {
+			if c.deleted {
+				delete(db.values, key)
+			} else {
+				db.values[key] = c.value
+			}
+		}
+
+		return nil
+	})
+}
+
+func (db *MemoryDatabase) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	// Copy the matching entries so fn may write to the database
+	db.mutex.RLock()
+	var keys []string
+	for key := range db.values {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = append([]byte{}, db.values[key]...)
+	}
+	db.mutex.RUnlock()
+
+	for i, key := range keys {
+		if err := fn([]byte(key), values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *MemoryDatabase) Close() error {
+	return nil
+}
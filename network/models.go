@@ -34,4 +34,5 @@ type Version struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	Timestamp  int64
 }
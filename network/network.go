@@ -3,8 +3,10 @@ package network
 import (
 	"blockchain/main/blockchain"
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"gopkg.in/vrecan/death.v3"
 	"io"
@@ -13,13 +15,22 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"sort"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
 	protocol      = "tcp"
 	version       = 1
 	commandLength = 12
+
+	// Misbehavior score at which a peer is disconnected
+	banScore = 100
+
+	// Score of a transaction spending unknown outputs, which a peer ahead of us can send honestly
+	missingInputScore = 10
 )
 
 var (
@@ -27,7 +38,21 @@ var (
 	mineAddress     string
 	KnownNodes      = []string{"localhost:3000"}
 	blocksInTransit [][]byte
+
+	// Misbehavior scores keyed by the host peers connect from, which unlike the address
+	// in their messages they cannot choose
+	peerScores     = make(map[string]int)
+	peerScoresLock sync.Mutex
+
+	// Transactions waiting to be mined, keyed by hex encoded ID
 	memoryPool      = make(map[string]blockchain.Transaction)
+	memoryPoolMutex sync.Mutex
+
+	// Miner of the node, whether it is mining and the function stopping the block it is working on
+	miner        = blockchain.NewMiner(0)
+	miningMutex  sync.Mutex
+	mining       bool
+	cancelMining context.CancelFunc
 )
 
 func RequestBlocks() {
@@ -119,7 +144,7 @@ func SendVersion(addr string, chain *blockchain.BlockChain) {
 	fmt.Println("Send version command: " + addr)
 
 	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+	payload := GobEncode(Version{version, bestHeight, nodeAddress, time.Now().Unix()})
 
 	request := append(CmdToBytes("version"), payload...)
 
@@ -144,7 +169,7 @@ func HandleAddr(request []byte) {
 	RequestBlocks()
 }
 
-func HandleBlock(request []byte, chain *blockchain.BlockChain) {
+func HandleBlock(request []byte, chain *blockchain.BlockChain, peer string) {
 	var buff bytes.Buffer
 	var payload Block
 
@@ -156,21 +181,40 @@ func HandleBlock(request []byte, chain *blockchain.BlockChain) {
 	}
 
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block, err := blockchain.DecodeBlock(blockData)
+	if err != nil {
+		fmt.Printf("Received a malformed block: %s\n", err)
+		PenalizePeer(peer, payload.AddrFrom, banScore)
+		return
+	}
 
 	fmt.Println("Received a new block!")
-	chain.AddBlock(block)
+
+	oldTip := chain.Tip()
+
+	if err := chain.AddBlock(block); err != nil {
+		fmt.Println(err)
+
+		// A block too far in the future may become valid later, so only the other rules get the peer banned
+		var validationErr *blockchain.ValidationError
+		if errors.As(err, &validationErr) && errors.Is(err, blockchain.ErrTimeTooNew) == false {
+			PenalizePeer(peer, payload.AddrFrom, banScore)
+		}
+		return
+	}
 
 	fmt.Printf("Added block %x\n", block.Hash)
 
+	// The block being mined no longer extends the tip
+	if bytes.Compare(oldTip, chain.Tip()) != 0 {
+		StopMining()
+	}
+
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
 		SendGetData(payload.AddrFrom, "block", blockHash)
 
 		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{chain}
-		UTXOSet.Reindex()
 	}
 }
 
@@ -207,7 +251,7 @@ func HandleInv(request []byte) {
 	if payload.Type == "tx" {
 		txID := payload.Items[0]
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
+		if _, ok := getPoolTx(hex.EncodeToString(txID)); ok == false {
 			SendGetData(payload.AddrFrom, "tx", txID)
 		}
 	}
@@ -254,14 +298,16 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+		tx, ok := getPoolTx(hex.EncodeToString(payload.ID))
+		if ok == false {
+			return
+		}
 
 		SendTx(payload.AddrFrom, &tx)
 	}
 }
 
-func HandleTx(request []byte, chain *blockchain.BlockChain) {
+func HandleTx(request []byte, chain *blockchain.BlockChain, peer string) {
 	var buff bytes.Buffer
 	var payload Tx
 
@@ -274,10 +320,43 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
+	// The ID is derived from the transaction contents while decoding
+	tx, err := blockchain.DecodeTransaction(txData)
+	if err != nil {
+		fmt.Printf("Received a malformed transaction: %s\n", err)
+		PenalizePeer(peer, payload.AddrFrom, banScore)
+		return
+	}
+
+	// Coinbases are only valid as the first transaction of a block
+	if tx.IsCoinbase() {
+		fmt.Printf("Rejected coinbase transaction %x\n", tx.ID)
+		PenalizePeer(peer, payload.AddrFrom, banScore)
+		return
+	}
+
+	// Transactions that cannot be mined in the next block are not kept until they can.
+	// Lock times pass eventually, so only the other failures count against the peer
+	if err := chain.CheckLocks(&tx); err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		if errors.Is(err, blockchain.ErrMissingInput) {
+			PenalizePeer(peer, payload.AddrFrom, missingInputScore)
+		}
+		return
+	}
+
+	if chain.VerifyTransaction(&tx) == false {
+		fmt.Printf("Rejected invalid transaction %x\n", tx.ID)
+		PenalizePeer(peer, payload.AddrFrom, banScore)
+		return
+	}
+
+	memoryPoolMutex.Lock()
 	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	poolSize := len(memoryPool)
+	memoryPoolMutex.Unlock()
 
-	fmt.Printf("[Handle Tx] From: %s, MemoryPool Size: %d\n", payload.AddrFrom, len(memoryPool))
+	fmt.Printf("[Handle Tx] From: %s, MemoryPool Size: %d\n", payload.AddrFrom, poolSize)
 
 	if nodeAddress == KnownNodes[0] {
 		for _, node := range KnownNodes {
@@ -287,55 +366,192 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 		}
 	} else {
 		fmt.Println("Waiting more transactions to mine.")
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
+		if poolSize >= 2 && len(mineAddress) > 0 {
 			fmt.Println("Starting mining..")
 			MineTx(chain)
 		}
 	}
 }
 
+// Mines the transactions of the memory pool until it is empty. Only one block is mined at a time,
+// so a call made while the node is mining returns at once and the running call picks up new transactions
 func MineTx(chain *blockchain.BlockChain) {
-	var txs []*blockchain.Transaction
+	miningMutex.Lock()
+	if mining {
+		miningMutex.Unlock()
+		return
+	}
+	mining = true
+	miningMutex.Unlock()
 
-	for id := range memoryPool {
-		tx := memoryPool[id]
+	defer func() {
+		miningMutex.Lock()
+		mining = false
+		cancelMining = nil
+		miningMutex.Unlock()
+	}()
 
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
-		}
+	for mineBlock(chain) {
 	}
+}
+
+// Mines one block of the memory pool transactions. Reports whether another block should be mined
+func mineBlock(chain *blockchain.BlockChain) bool {
+	txs, fees, evicted := selectTransactions(chain, poolTransactions())
+	removeFromPool(evicted)
 
 	if len(txs) == 0 {
 		fmt.Println("All Transactions are invalid")
-		return
+		return false
 	}
 
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
-	txs = append(txs, cbTx)
+	// Coinbase must be the first transaction of the block
+	cbTx := blockchain.CoinbaseTx(mineAddress, "", chain.GetBestHeight()+1, fees)
+	txs = append([]*blockchain.Transaction{cbTx}, txs...)
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	ctx, cancel := context.WithCancel(context.Background())
+	miningMutex.Lock()
+	cancelMining = cancel
+	miningMutex.Unlock()
+	defer cancel()
 
-	fmt.Println("New Block mined")
+	newBlock, err := chain.MineBlockContext(ctx, miner, txs)
+	if err != nil {
+		fmt.Printf("Mining stopped: %s\n", err)
+		return false
+	}
+
+	fmt.Printf("New Block mined at %.0f hashes/s\n", miner.HashRate())
 
+	// Transactions spending what the block spent can never be mined
+	spent := make(map[string]bool)
+	var mined []string
 	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+		mined = append(mined, hex.EncodeToString(tx.ID))
+		for _, in := range tx.Inputs {
+			spent[outpoint(in)] = true
+		}
+	}
+
+	for _, tx := range poolTransactions() {
+		for _, in := range tx.Inputs {
+			if spent[outpoint(in)] {
+				mined = append(mined, hex.EncodeToString(tx.ID))
+				break
+			}
+		}
 	}
 
+	poolSize := removeFromPool(mined)
+
 	for _, node := range KnownNodes {
 		if node != nodeAddress {
 			SendInv(node, "block", [][]byte{newBlock.Hash})
 		}
 	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+	return poolSize > 0
+}
+
+// Chooses the transactions of the next block from the candidates, the best paying first.
+// A candidate spending an output an already chosen one spends is left for a later block.
+// Returns the chosen transactions, their fees and the IDs of the candidates that are not valid
+func selectTransactions(chain *blockchain.BlockChain, candidates []blockchain.Transaction) ([]*blockchain.Transaction, int, []string) {
+	var valid []*blockchain.Transaction
+	var evicted []string
+	txFees := make(map[string]int)
+
+	for _, tx := range candidates {
+		tx := tx
+		txID := hex.EncodeToString(tx.ID)
+
+		if chain.VerifyTransaction(&tx) == false {
+			evicted = append(evicted, txID)
+			continue
+		}
+
+		fee, err := chain.TransactionFee(&tx)
+		if err != nil {
+			evicted = append(evicted, txID)
+			continue
+		}
+
+		txFees[txID] = fee
+		valid = append(valid, &tx)
+	}
+
+	// Include the best paying transactions first, by ID on equal fees so every run chooses the same
+	sort.Slice(valid, func(i, j int) bool {
+		feeI, feeJ := txFees[hex.EncodeToString(valid[i].ID)], txFees[hex.EncodeToString(valid[j].ID)]
+		if feeI != feeJ {
+			return feeI > feeJ
+		}
+		return bytes.Compare(valid[i].ID, valid[j].ID) < 0
+	})
+
+	var txs []*blockchain.Transaction
+	spent := make(map[string]bool)
+	fees := 0
+
+Candidates:
+	for _, tx := range valid {
+		for _, in := range tx.Inputs {
+			if spent[outpoint(in)] {
+				continue Candidates
+			}
+		}
+
+		for _, in := range tx.Inputs {
+			spent[outpoint(in)] = true
+		}
+
+		fees += txFees[hex.EncodeToString(tx.ID)]
+		txs = append(txs, tx)
 	}
+
+	return txs, fees, evicted
+}
+
+func outpoint(in blockchain.TxInput) string {
+	return fmt.Sprintf("%x:%d", in.ID, in.Out)
+}
+
+// Removes the transactions with the hex encoded IDs from the memory pool. Returns the size left
+func removeFromPool(txIDs []string) int {
+	memoryPoolMutex.Lock()
+	defer memoryPoolMutex.Unlock()
+
+	for _, txID := range txIDs {
+		delete(memoryPool, txID)
+	}
+
+	return len(memoryPool)
+}
+
+// Returns the memory pool transaction with the hex encoded ID
+func getPoolTx(txID string) (blockchain.Transaction, bool) {
+	memoryPoolMutex.Lock()
+	defer memoryPoolMutex.Unlock()
+
+	tx, ok := memoryPool[txID]
+
+	return tx, ok
+}
+
+// Returns a copy of the memory pool transactions
+func poolTransactions() []blockchain.Transaction {
+	memoryPoolMutex.Lock()
+	defer memoryPoolMutex.Unlock()
+
+	var txs []blockchain.Transaction
+	for _, tx := range memoryPool {
+		txs = append(txs, tx)
+	}
+
+	return txs
 }
 
-func HandleVersion(request []byte, chain *blockchain.BlockChain) {
+func HandleVersion(request []byte, chain *blockchain.BlockChain, peer string) {
 	var buff bytes.Buffer
 	var payload Version
 
@@ -347,6 +563,11 @@ func HandleVersion(request []byte, chain *blockchain.BlockChain) {
 		log.Panic(err)
 	}
 
+	// The peer clock feeds the adjusted network time blocks are checked against
+	if payload.Timestamp != 0 {
+		blockchain.AddTimeSample(payload.AddrFrom, payload.Timestamp)
+	}
+
 	bestHeight := chain.GetBestHeight()
 	otherHeight := payload.BestHeight
 
@@ -360,12 +581,20 @@ func HandleVersion(request []byte, chain *blockchain.BlockChain) {
 	}
 
 	// Add new node to known nodes
-	if !NodeIsKnown(payload.AddrFrom) {
+	if !NodeIsKnown(payload.AddrFrom) && !IsBanned(peer) {
 		KnownNodes = append(KnownNodes, payload.AddrFrom)
 	}
 }
 
 func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
+	defer conn.Close()
+
+	peer := peerHost(conn)
+	if IsBanned(peer) {
+		fmt.Printf("Dropped connection from banned peer %s\n", peer)
+		return
+	}
+
 	req, err := ioutil.ReadAll(conn)
 
 	if err != nil {
@@ -379,7 +608,7 @@ func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
 	case "addr":
 		HandleAddr(req)
 	case "block":
-		HandleBlock(req, chain)
+		HandleBlock(req, chain, peer)
 	case "inv":
 		HandleInv(req)
 	case "getblocks":
@@ -387,18 +616,29 @@ func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
 	case "getdata":
 		HandleGetData(req, chain)
 	case "tx":
-		HandleTx(req, chain)
+		HandleTx(req, chain, peer)
 	case "version":
-		HandleVersion(req, chain)
+		HandleVersion(req, chain, peer)
 	default:
 		fmt.Println("Unknown command")
 	}
 
 }
 
-func StartServer(nodeID, minerAddress string) {
+// Stops mining the current block, if any
+func StopMining() {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+
+	if cancelMining != nil {
+		cancelMining()
+	}
+}
+
+func StartServer(nodeID, minerAddress string, workers int) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	mineAddress = minerAddress
+	miner = blockchain.NewMiner(workers)
 
 	ln, err := net.Listen(protocol, nodeAddress)
 
@@ -415,7 +655,7 @@ func StartServer(nodeID, minerAddress string) {
 
 	chain := blockchain.ContinueBlockChain(nodeID)
 	defer func() {
-		err := chain.Database.DB.Close()
+		err := chain.Database.Close()
 		if err != nil {
 			log.Panic(err)
 		}
@@ -447,6 +687,49 @@ func NodeIsKnown(addr string) bool {
 	return false
 }
 
+// Returns the host a connection comes from
+func peerHost(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// Adds to the misbehavior score of the peer connecting from the host. Once it reaches
+// the ban score, the address the peer announced is forgotten
+func PenalizePeer(peer, addr string, score int) {
+	peerScoresLock.Lock()
+	defer peerScoresLock.Unlock()
+
+	peerScores[peer] += score
+	fmt.Printf("Peer %s misbehaved, score: %d\n", peer, peerScores[peer])
+
+	if peerScores[peer] < banScore {
+		return
+	}
+
+	var updatedNodes []string
+	for _, node := range KnownNodes {
+		if node != addr {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+
+	KnownNodes = updatedNodes
+}
+
+// Reports whether the peer connecting from the host is banned
+func IsBanned(peer string) bool {
+	peerScoresLock.Lock()
+	defer peerScoresLock.Unlock()
+
+	return peerScores[peer] >= banScore
+}
+
 func CloseDB(chain *blockchain.BlockChain) {
 	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
@@ -454,7 +737,7 @@ func CloseDB(chain *blockchain.BlockChain) {
 		defer os.Exit(1)
 		defer runtime.Goexit()
 
-		err := chain.Database.DB.Close()
+		err := chain.Database.Close()
 		if err != nil {
 			log.Panic(err)
 		}
@@ -0,0 +1,144 @@
+package network
+
+import (
+	"blockchain/main/blockchain"
+	"blockchain/main/database"
+	"blockchain/main/wallet"
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// Creates a chain in memory whose coinbases pay the wallet, the first of them mature
+func newTestChain(w *wallet.Wallet) *blockchain.BlockChain {
+	chain := blockchain.NewBlockChain(database.NewMemoryDatabase(), string(w.Address()))
+
+	for i := 0; i <= blockchain.CoinbaseMaturity; i++ {
+		coinbase := blockchain.CoinbaseTx(string(w.Address()), "", chain.GetBestHeight()+1, 0)
+		chain.MineBlock([]*blockchain.Transaction{coinbase})
+	}
+
+	return chain
+}
+
+func TestSelectTransactionsSkipsConflicts(t *testing.T) {
+	w := wallet.MakeWallet()
+	to := string(wallet.MakeWallet().Address())
+	chain := newTestChain(w)
+	UTXO := blockchain.UTXOSet{BlockChain: chain}
+
+	// Both spend the same mature coinbase
+	cheap := blockchain.NewTransaction(w, to, 10, 1, 0, &UTXO)
+	dear := blockchain.NewTransaction(w, to, 10, 3, 0, &UTXO)
+	if bytes.Equal(cheap.Inputs[0].ID, dear.Inputs[0].ID) == false {
+		t.Fatal("transactions do not conflict")
+	}
+
+	// Spends more than its input holds
+	invalid := *blockchain.NewTransaction(w, to, 10, 1, 0, &UTXO)
+	invalid.Outputs[0].Value = 1000
+	invalid.ID = invalid.Hash()
+
+	txs, fees, evicted := selectTransactions(chain, []blockchain.Transaction{*cheap, *dear, invalid})
+
+	if len(txs) != 1 || bytes.Equal(txs[0].ID, dear.ID) == false || fees != 3 {
+		t.Fatal("expected only the best paying of the conflicting transactions", len(txs), fees)
+	}
+	if len(evicted) != 1 || evicted[0] != hex.EncodeToString(invalid.ID) {
+		t.Fatal("expected the invalid transaction to be evicted", evicted)
+	}
+
+	// The block is accepted, so the node keeps mining
+	coinbase := blockchain.CoinbaseTx(to, "", chain.GetBestHeight()+1, fees)
+	chain.MineBlock(append([]*blockchain.Transaction{coinbase}, txs...))
+}
+
+func TestMineBlockEvictsConflicts(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := newTestChain(w)
+	UTXO := blockchain.UTXOSet{BlockChain: chain}
+	mineAddress = string(wallet.MakeWallet().Address())
+
+	cheap := blockchain.NewTransaction(w, mineAddress, 10, 1, 0, &UTXO)
+	dear := blockchain.NewTransaction(w, mineAddress, 10, 3, 0, &UTXO)
+
+	memoryPool = map[string]blockchain.Transaction{
+		hex.EncodeToString(cheap.ID): *cheap,
+		hex.EncodeToString(dear.ID):  *dear,
+	}
+
+	if mineBlock(chain) {
+		t.Fatal("nothing should be left to mine")
+	}
+	if len(memoryPool) != 0 {
+		t.Fatal("conflicting transaction was kept in the memory pool")
+	}
+	if _, err := chain.FindTransaction(dear.ID); err != nil {
+		t.Fatal("best paying transaction was not mined")
+	}
+}
+
+func TestHandleTxRejectsUnknownInputs(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := newTestChain(w)
+	UTXO := blockchain.UTXOSet{BlockChain: chain}
+	memoryPool = make(map[string]blockchain.Transaction)
+	peerScores = make(map[string]int)
+
+	tx := blockchain.NewTransaction(w, string(w.Address()), 10, 1, 0, &UTXO)
+	tx.Inputs[0].ID = bytes.Repeat([]byte{1}, 32)
+	tx.ID = tx.Hash()
+
+	peer := "127.0.0.1"
+	request := append(CmdToBytes("tx"), GobEncode(Tx{"localhost:4001", tx.Serialize()})...)
+	HandleTx(request, chain, peer)
+
+	if len(memoryPool) != 0 {
+		t.Fatal("transaction with an unknown input entered the memory pool")
+	}
+	if peerScores[peer] != missingInputScore {
+		t.Fatal("peer was not penalized", peerScores[peer])
+	}
+}
+
+func TestHandleTxRejectsCoinbase(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := newTestChain(w)
+	memoryPool = make(map[string]blockchain.Transaction)
+	peerScores = make(map[string]int)
+
+	coinbase := blockchain.CoinbaseTx(string(w.Address()), "", chain.GetBestHeight()+1, 0)
+
+	peer := "127.0.0.1"
+	request := append(CmdToBytes("tx"), GobEncode(Tx{"localhost:4002", coinbase.Serialize()})...)
+	HandleTx(request, chain, peer)
+
+	if len(memoryPool) != 0 || IsBanned(peer) == false {
+		t.Fatal("coinbase from a peer was not rejected")
+	}
+}
+
+func TestBannedPeerIsDropped(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain := newTestChain(w)
+	UTXO := blockchain.UTXOSet{BlockChain: chain}
+	memoryPool = make(map[string]blockchain.Transaction)
+	peerScores = make(map[string]int)
+
+	tx := blockchain.NewTransaction(w, string(w.Address()), 10, 1, 0, &UTXO)
+	request := append(CmdToBytes("tx"), GobEncode(Tx{"localhost:4003", tx.Serialize()})...)
+
+	client, server := net.Pipe()
+	PenalizePeer(peerHost(server), "localhost:4003", banScore)
+
+	go func() {
+		client.Write(request)
+		client.Close()
+	}()
+	HandleConnection(server, chain)
+
+	if len(memoryPool) != 0 {
+		t.Fatal("transaction from a banned peer entered the memory pool")
+	}
+}
@@ -0,0 +1,413 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+// Threshold below which a lock time is a block height rather than a unix time
+const LockTimeThreshold = 500000000
+
+// Input sequence numbers carry relative lock times
+const (
+	// Sequence of an input without a relative lock time that also leaves the transaction lock time disabled
+	MaxSequence = 0xffffffff
+
+	// Set when the sequence carries no relative lock time
+	SequenceDisableFlag = 1 << 31
+
+	// Set when the relative lock time counts units of 512 seconds rather than blocks
+	SequenceTypeFlag = 1 << 22
+
+	SequenceMask        = 0x0000ffff
+	SequenceGranularity = 9
+)
+
+var (
+	ErrNotPushOnly       = errors.New("unlocking script may only push data")
+	ErrStackUnderflow    = errors.New("operation needs more stack items")
+	ErrStackOverflow     = errors.New("stack is too large")
+	ErrTooManyOps        = errors.New("script has too many operations")
+	ErrBadOpcode         = errors.New("opcode is not known")
+	ErrUnbalancedIf      = errors.New("conditional is not balanced")
+	ErrVerifyFailed      = errors.New("verify operation failed")
+	ErrOpReturn          = errors.New("script is marked unspendable")
+	ErrEvalFalse         = errors.New("script ended with a false result")
+	ErrBadMultisig       = errors.New("multisig key or signature count is out of range")
+	ErrNegativeLockTime  = errors.New("lock time is negative")
+	ErrUnsatisfiedLocked = errors.New("lock time has not been reached")
+)
+
+// Provides what the scripts check against the spending transaction
+type Checker interface {
+	// Reports whether sig is a valid signature of the spending input by the public key
+	CheckSig(sig, pubKey []byte) bool
+
+	// Reports whether the spending transaction is final at the lock time, a height or a unix time
+	CheckLockTime(lockTime int64) bool
+
+	// Reports whether the spending input has a relative lock time of at least the sequence, of the same type
+	CheckSequence(sequence int64) bool
+}
+
+// Runs the unlocking script and then the locking script on the stack it left.
+// For a pay-to-script-hash output the last item pushed by the unlocking script is the redeem script,
+// which then runs on the rest of the stack. The input is valid when this returns nil
+func Verify(unlocking, locking []byte, checker Checker) error {
+	if IsPushOnly(unlocking) == false {
+		return ErrNotPushOnly
+	}
+
+	var stack [][]byte
+
+	stack, err := Execute(unlocking, stack, checker)
+	if err != nil {
+		return err
+	}
+	unlocked := append([][]byte{}, stack...)
+
+	stack, err = Execute(locking, stack, checker)
+	if err != nil {
+		return err
+	}
+
+	if len(stack) == 0 || asBool(stack[len(stack)-1]) == false {
+		return ErrEvalFalse
+	}
+
+	if ExtractScriptHash(locking) == nil {
+		return nil
+	}
+
+	// The locking script only checked the hash of the redeem script
+	if len(unlocked) == 0 {
+		return ErrStackUnderflow
+	}
+	redeem := unlocked[len(unlocked)-1]
+
+	stack, err = Execute(redeem, unlocked[:len(unlocked)-1], checker)
+	if err != nil {
+		return err
+	}
+
+	if len(stack) == 0 || asBool(stack[len(stack)-1]) == false {
+		return ErrEvalFalse
+	}
+
+	return nil
+}
+
+// Executes the script on the stack and returns the resulting stack
+func Execute(script []byte, stack [][]byte, checker Checker) ([][]byte, error) {
+	instructions, err := Parse(script)
+	if err != nil {
+		return nil, err
+	}
+
+	// Whether each enclosing conditional branch is being executed
+	var conditions []bool
+	ops := 0
+
+	for _, ins := range instructions {
+		executing := true
+		for _, condition := range conditions {
+			executing = executing && condition
+		}
+
+		if ins.Opcode > OP_16 {
+			ops++
+			if ops > MaxOps {
+				return nil, ErrTooManyOps
+			}
+		}
+
+		switch ins.Opcode {
+		case OP_IF, OP_NOTIF:
+			branch := false
+			if executing {
+				if len(stack) < 1 {
+					return nil, ErrStackUnderflow
+				}
+				branch = asBool(stack[len(stack)-1]) == (ins.Opcode == OP_IF)
+				stack = stack[:len(stack)-1]
+			}
+			conditions = append(conditions, branch)
+			continue
+
+		case OP_ELSE:
+			if len(conditions) == 0 {
+				return nil, ErrUnbalancedIf
+			}
+			conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			continue
+
+		case OP_ENDIF:
+			if len(conditions) == 0 {
+				return nil, ErrUnbalancedIf
+			}
+			conditions = conditions[:len(conditions)-1]
+			continue
+		}
+
+		if executing == false {
+			continue
+		}
+
+		stack, err = step(ins, stack, checker, &ops)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(stack) > MaxStackSize {
+			return nil, ErrStackOverflow
+		}
+	}
+
+	if len(conditions) > 0 {
+		return nil, ErrUnbalancedIf
+	}
+
+	return stack, nil
+}
+
+// Executes a single instruction outside of conditionals. Operations it does besides its own are added to ops
+func step(ins Instruction, stack [][]byte, checker Checker, ops *int) ([][]byte, error) {
+	pop := func() []byte {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return item
+	}
+	need := func(n int) error {
+		if len(stack) < n {
+			return ErrStackUnderflow
+		}
+		return nil
+	}
+
+	switch op := ins.Opcode; {
+	case ins.Data != nil:
+		stack = append(stack, ins.Data)
+
+	case op == OP_0:
+		stack = append(stack, []byte{})
+
+	case op == OP_1NEGATE:
+		stack = append(stack, EncodeNumber(-1))
+
+	case op >= OP_1 && op <= OP_16:
+		stack = append(stack, EncodeNumber(int64(op-OP_1+1)))
+
+	case op == OP_VERIFY:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		if asBool(pop()) == false {
+			return nil, ErrVerifyFailed
+		}
+
+	case op == OP_RETURN:
+		return nil, ErrOpReturn
+
+	case op == OP_DROP:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		pop()
+
+	case op == OP_DUP:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		stack = append(stack, stack[len(stack)-1])
+
+	case op == OP_SWAP:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		stack[len(stack)-1], stack[len(stack)-2] = stack[len(stack)-2], stack[len(stack)-1]
+
+	case op == OP_SIZE:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		stack = append(stack, EncodeNumber(int64(len(stack[len(stack)-1]))))
+
+	case op == OP_EQUAL, op == OP_EQUALVERIFY:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		equal := bytes.Equal(pop(), pop())
+		if op == OP_EQUALVERIFY {
+			if equal == false {
+				return nil, ErrVerifyFailed
+			}
+		} else {
+			stack = append(stack, fromBool(equal))
+		}
+
+	case op == OP_SHA256:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(pop())
+		stack = append(stack, hash[:])
+
+	case op == OP_HASH160:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		stack = append(stack, Hash160(pop()))
+
+	case op == OP_CHECKSIG, op == OP_CHECKSIGVERIFY:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		pubKey := pop()
+		sig := pop()
+		valid := len(sig) > 0 && checker.CheckSig(sig, pubKey)
+		if op == OP_CHECKSIGVERIFY {
+			if valid == false {
+				return nil, ErrVerifyFailed
+			}
+		} else {
+			stack = append(stack, fromBool(valid))
+		}
+
+	case op == OP_CHECKMULTISIG, op == OP_CHECKMULTISIGVERIFY:
+		var valid bool
+		var err error
+		stack, valid, err = checkMultisig(stack, checker, ops)
+		if err != nil {
+			return nil, err
+		}
+		if op == OP_CHECKMULTISIGVERIFY {
+			if valid == false {
+				return nil, ErrVerifyFailed
+			}
+		} else {
+			stack = append(stack, fromBool(valid))
+		}
+
+	case op == OP_CHECKLOCKTIMEVERIFY:
+		// The lock time is left on the stack
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		lockTime, err := DecodeNumber(stack[len(stack)-1], 5)
+		if err != nil {
+			return nil, err
+		}
+		if lockTime < 0 {
+			return nil, ErrNegativeLockTime
+		}
+		if checker.CheckLockTime(lockTime) == false {
+			return nil, ErrUnsatisfiedLocked
+		}
+
+	case op == OP_CHECKSEQUENCEVERIFY:
+		// The relative lock time is left on the stack
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		sequence, err := DecodeNumber(stack[len(stack)-1], 5)
+		if err != nil {
+			return nil, err
+		}
+		if sequence < 0 {
+			return nil, ErrNegativeLockTime
+		}
+		// Does nothing when the disable flag is set
+		if sequence&SequenceDisableFlag == 0 && checker.CheckSequence(sequence) == false {
+			return nil, ErrUnsatisfiedLocked
+		}
+
+	default:
+		return nil, ErrBadOpcode
+	}
+
+	return stack, nil
+}
+
+// Pops <sig 1> ... <sig m> <m> <key 1> ... <key n> <n> and checks that the signatures
+// were made by the keys in the same order. Each key counts as an operation
+func checkMultisig(stack [][]byte, checker Checker, ops *int) ([][]byte, bool, error) {
+	popNumber := func() (int, error) {
+		if len(stack) < 1 {
+			return 0, ErrStackUnderflow
+		}
+		n, err := DecodeNumber(stack[len(stack)-1], 4)
+		stack = stack[:len(stack)-1]
+		return int(n), err
+	}
+
+	keyCount, err := popNumber()
+	if err != nil {
+		return nil, false, err
+	}
+	if keyCount < 1 || keyCount > MaxMultisigKeys || len(stack) < keyCount {
+		return nil, false, ErrBadMultisig
+	}
+
+	*ops += keyCount
+	if *ops > MaxOps {
+		return nil, false, ErrTooManyOps
+	}
+	keys := stack[len(stack)-keyCount:]
+	stack = stack[:len(stack)-keyCount]
+
+	sigCount, err := popNumber()
+	if err != nil {
+		return nil, false, err
+	}
+	if sigCount < 1 || sigCount > keyCount || len(stack) < sigCount {
+		return nil, false, ErrBadMultisig
+	}
+	sigs := stack[len(stack)-sigCount:]
+	stack = stack[:len(stack)-sigCount]
+
+	// Each signature must match a key after the one matching the signature before
+	key := 0
+	for _, sig := range sigs {
+		for key < len(keys) && (len(sig) == 0 || checker.CheckSig(sig, keys[key]) == false) {
+			key++
+		}
+		if key == len(keys) {
+			return stack, false, nil
+		}
+		key++
+	}
+
+	return stack, true, nil
+}
+
+// Returns RIPEMD-160(SHA-256(data)), the hash addresses are made of
+func Hash160(data []byte) []byte {
+	hash := sha256.Sum256(data)
+
+	hasher := ripemd160.New()
+	hasher.Write(hash[:])
+
+	return hasher.Sum(nil)
+}
+
+// Any non-zero value except negative zero is true
+func asBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+
+	return false
+}
+
+func fromBool(value bool) []byte {
+	if value {
+		return []byte{1}
+	}
+
+	return []byte{}
+}
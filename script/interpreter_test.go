@@ -0,0 +1,255 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// Accepts the signature "sig:" followed by the public key, and lock times up to its own
+type testChecker struct {
+	lockTime int64
+	sequence int64
+}
+
+func testSig(pubKey []byte) []byte {
+	return append([]byte("sig:"), pubKey...)
+}
+
+func (c testChecker) CheckSig(sig, pubKey []byte) bool {
+	return bytes.Equal(sig, testSig(pubKey))
+}
+
+func (c testChecker) CheckLockTime(lockTime int64) bool {
+	return lockTime <= c.lockTime
+}
+
+func (c testChecker) CheckSequence(sequence int64) bool {
+	return sequence <= c.sequence
+}
+
+func TestPayToPubKeyHash(t *testing.T) {
+	pubKey, other := []byte("key"), []byte("other key")
+	locking := PayToPubKeyHash(Hash160(pubKey))
+
+	if err := Verify(PayToPubKeyHashUnlock(testSig(pubKey), pubKey), locking, testChecker{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(PayToPubKeyHashUnlock(testSig(other), other), locking, testChecker{}); err != ErrVerifyFailed {
+		t.Fatalf("expected %v, got %v", ErrVerifyFailed, err)
+	}
+	if err := Verify(PayToPubKeyHashUnlock(testSig(other), pubKey), locking, testChecker{}); err != ErrEvalFalse {
+		t.Fatalf("expected %v, got %v", ErrEvalFalse, err)
+	}
+
+	if bytes.Equal(ExtractPubKeyHash(locking), Hash160(pubKey)) == false {
+		t.Fatal("pubkey hash is not extracted")
+	}
+}
+
+func TestUnlockingScriptMustOnlyPush(t *testing.T) {
+	pubKey := []byte("key")
+	unlocking := NewBuilder().AddData(testSig(pubKey)).AddData(pubKey).AddOp(OP_DUP).AddOp(OP_DROP).Script()
+
+	if err := Verify(unlocking, PayToPubKeyHash(Hash160(pubKey)), testChecker{}); err != ErrNotPushOnly {
+		t.Fatalf("expected %v, got %v", ErrNotPushOnly, err)
+	}
+}
+
+func TestMultisig(t *testing.T) {
+	keys := [][]byte{[]byte("key 1"), []byte("key 2"), []byte("key 3")}
+	locking := Multisig(2, keys)
+
+	cases := []struct {
+		sigs  [][]byte
+		valid bool
+	}{
+		{[][]byte{testSig(keys[0]), testSig(keys[1])}, true},
+		{[][]byte{testSig(keys[0]), testSig(keys[2])}, true},
+		{[][]byte{testSig(keys[2]), testSig(keys[0])}, false},
+		{[][]byte{testSig(keys[1]), testSig(keys[1])}, false},
+	}
+
+	for _, c := range cases {
+		err := Verify(MultisigUnlock(c.sigs), locking, testChecker{})
+		if (err == nil) != c.valid {
+			t.Fatal("unexpected result", c.sigs, err)
+		}
+	}
+
+	if err := Verify(MultisigUnlock([][]byte{testSig(keys[0])}), locking, testChecker{}); err == nil {
+		t.Fatal("one signature unlocked a 2-of-3 multisig")
+	}
+
+	m, pubKeys, ok := ExtractMultisig(locking)
+	if ok == false || m != 2 || len(pubKeys) != 3 || bytes.Equal(pubKeys[2], keys[2]) == false {
+		t.Fatal("multisig is not extracted")
+	}
+}
+
+func TestPayToScriptHash(t *testing.T) {
+	keys := [][]byte{[]byte("key 1"), []byte("key 2")}
+	redeem := Multisig(2, keys)
+	locking := PayToScriptHash(Hash160(redeem))
+	sigs := [][]byte{testSig(keys[0]), testSig(keys[1])}
+
+	if err := Verify(MultisigScriptHashUnlock(sigs, redeem), locking, testChecker{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The redeem script matches the hash, but its signatures must still be valid
+	if err := Verify(MultisigScriptHashUnlock(sigs[:1], redeem), locking, testChecker{}); err == nil {
+		t.Fatal("redeem script ran without enough signatures")
+	}
+
+	other := Multisig(1, keys)
+	if err := Verify(MultisigScriptHashUnlock(sigs[:1], other), locking, testChecker{}); err != ErrEvalFalse {
+		t.Fatalf("expected %v, got %v", ErrEvalFalse, err)
+	}
+}
+
+func TestHashLock(t *testing.T) {
+	pubKey := []byte("key")
+	preimage := []byte("preimage")
+	hash := sha256.Sum256(preimage)
+	locking := HashLock(hash[:], Hash160(pubKey))
+
+	if err := Verify(HashLockUnlock(testSig(pubKey), pubKey, preimage), locking, testChecker{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(HashLockUnlock(testSig(pubKey), pubKey, []byte("guess")), locking, testChecker{}); err != ErrVerifyFailed {
+		t.Fatalf("expected %v, got %v", ErrVerifyFailed, err)
+	}
+}
+
+func TestTimeLocks(t *testing.T) {
+	pubKey := []byte("key")
+	unlocking := PayToPubKeyHashUnlock(testSig(pubKey), pubKey)
+
+	locking := TimeLock(100, Hash160(pubKey))
+	if err := Verify(unlocking, locking, testChecker{lockTime: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(unlocking, locking, testChecker{lockTime: 99}); err != ErrUnsatisfiedLocked {
+		t.Fatalf("expected %v, got %v", ErrUnsatisfiedLocked, err)
+	}
+
+	relative := RelativeTimeLock(10, Hash160(pubKey))
+	if err := Verify(unlocking, relative, testChecker{sequence: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(unlocking, relative, testChecker{sequence: 9}); err != ErrUnsatisfiedLocked {
+		t.Fatalf("expected %v, got %v", ErrUnsatisfiedLocked, err)
+	}
+
+	// Relative lock times with the disable flag set are not enforced
+	disabled := RelativeTimeLock(SequenceDisableFlag|10, Hash160(pubKey))
+	if err := Verify(unlocking, disabled, testChecker{}); err != nil {
+		t.Fatal(err)
+	}
+
+	negative := NewBuilder().AddInt(-1).AddOp(OP_CHECKLOCKTIMEVERIFY).Script()
+	if err := Verify(nil, negative, testChecker{}); err != ErrNegativeLockTime {
+		t.Fatalf("expected %v, got %v", ErrNegativeLockTime, err)
+	}
+}
+
+func TestHTLC(t *testing.T) {
+	recipient, refund := []byte("recipient"), []byte("refund")
+	secret := bytes.Repeat([]byte{7}, HTLCSecretSize)
+	secretHash := sha256.Sum256(secret)
+	locking := HTLC(secretHash[:], Hash160(recipient), 100, Hash160(refund))
+
+	redeem := HTLCRedeem(testSig(recipient), recipient, secret)
+	if err := Verify(redeem, locking, testChecker{}); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ExtractHTLCSecret(redeem), secret) == false {
+		t.Fatal("secret is not extracted")
+	}
+
+	// Secrets of another size would not be valid on every chain of a swap
+	short := secret[:HTLCSecretSize-1]
+	shortHash := sha256.Sum256(short)
+	shortLock := HTLC(shortHash[:], Hash160(recipient), 100, Hash160(refund))
+	if err := Verify(HTLCRedeem(testSig(recipient), recipient, short), shortLock, testChecker{}); err != ErrVerifyFailed {
+		t.Fatalf("expected %v, got %v", ErrVerifyFailed, err)
+	}
+
+	refundUnlock := HTLCRefund(testSig(refund), refund)
+	if err := Verify(refundUnlock, locking, testChecker{lockTime: 99}); err != ErrUnsatisfiedLocked {
+		t.Fatalf("expected %v, got %v", ErrUnsatisfiedLocked, err)
+	}
+	if err := Verify(refundUnlock, locking, testChecker{lockTime: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	secretHashOut, recipientHash, lockTime, refundHash, ok := ExtractHTLC(locking)
+	if ok == false || bytes.Equal(secretHashOut, secretHash[:]) == false || lockTime != 100 ||
+		bytes.Equal(recipientHash, Hash160(recipient)) == false || bytes.Equal(refundHash, Hash160(refund)) == false {
+		t.Fatal("contract is not extracted")
+	}
+}
+
+func TestNullDataIsUnspendable(t *testing.T) {
+	locking := NullData([]byte("data"))
+
+	if IsUnspendable(locking) == false {
+		t.Fatal("data output is spendable")
+	}
+	if err := Verify(nil, locking, testChecker{}); err != ErrOpReturn {
+		t.Fatalf("expected %v, got %v", ErrOpReturn, err)
+	}
+
+	if data, ok := ExtractNullData(locking); ok == false || bytes.Equal(data, []byte("data")) == false {
+		t.Fatal("data is not extracted")
+	}
+	if _, ok := ExtractNullData(NullData(make([]byte, MaxDataCarrierSize+1))); ok {
+		t.Fatal("data above MaxDataCarrierSize accepted")
+	}
+}
+
+func TestExecutionLimits(t *testing.T) {
+	unbalanced := NewBuilder().AddOp(OP_1).AddOp(OP_IF).AddOp(OP_1).Script()
+	if err := Verify(nil, unbalanced, testChecker{}); err != ErrUnbalancedIf {
+		t.Fatalf("expected %v, got %v", ErrUnbalancedIf, err)
+	}
+
+	b := NewBuilder().AddOp(OP_1)
+	for i := 0; i <= MaxOps; i++ {
+		b.AddOp(OP_DUP).AddOp(OP_DROP)
+	}
+	if err := Verify(nil, b.Script(), testChecker{}); err != ErrTooManyOps {
+		t.Fatalf("expected %v, got %v", ErrTooManyOps, err)
+	}
+
+	// Every key of a multisig counts as an operation
+	keys := make([][]byte, MaxMultisigKeys)
+	for i := range keys {
+		keys[i] = []byte{byte(i + 1)}
+	}
+	b = NewBuilder()
+	for i := 0; i*(MaxMultisigKeys+1) <= MaxOps; i++ {
+		b.AddOp(OP_0).AddOp(OP_1)
+		for _, key := range keys {
+			b.AddData(key)
+		}
+		b.AddInt(MaxMultisigKeys).AddOp(OP_CHECKMULTISIG).AddOp(OP_DROP)
+	}
+	if err := Verify(nil, b.AddOp(OP_1).Script(), testChecker{}); err != ErrTooManyOps {
+		t.Fatalf("expected %v, got %v", ErrTooManyOps, err)
+	}
+
+	// Pushes are not counted as operations
+	b = NewBuilder()
+	for i := 0; i <= MaxStackSize; i++ {
+		b.AddOp(OP_1)
+	}
+	if _, err := Execute(b.Script(), nil, testChecker{}); err != ErrStackOverflow {
+		t.Fatalf("expected %v, got %v", ErrStackOverflow, err)
+	}
+
+	if err := Verify(nil, []byte{0xff}, testChecker{}); err != ErrBadOpcode {
+		t.Fatalf("expected %v, got %v", ErrBadOpcode, err)
+	}
+}
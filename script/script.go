@@ -0,0 +1,231 @@
+package script
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Limits keeping the evaluation of any script cheap
+const (
+	MaxScriptSize   = 10000
+	MaxElementSize  = 520
+	MaxStackSize    = 1000
+	MaxOps          = 201
+	MaxMultisigKeys = 20
+)
+
+var (
+	ErrScriptTooLong   = errors.New("script is too long")
+	ErrElementTooLarge = errors.New("pushed data is too large")
+	ErrMalformedPush   = errors.New("push runs past the end of the script")
+	ErrBadNumber       = errors.New("number is not minimally encoded or too large")
+)
+
+// Operation read from a script. Data is set for pushes
+type Instruction struct {
+	Opcode byte
+	Data   []byte
+}
+
+// Splits the script into instructions
+func Parse(script []byte) ([]Instruction, error) {
+	if len(script) > MaxScriptSize {
+		return nil, ErrScriptTooLong
+	}
+
+	var instructions []Instruction
+
+	for pc := 0; pc < len(script); {
+		op := script[pc]
+		pc++
+
+		length := -1
+		switch {
+		case op > OP_0 && op < OP_PUSHDATA1:
+			length = int(op)
+		case op == OP_PUSHDATA1:
+			if pc+1 > len(script) {
+				return nil, ErrMalformedPush
+			}
+			length = int(script[pc])
+			pc++
+		case op == OP_PUSHDATA2:
+			if pc+2 > len(script) {
+				return nil, ErrMalformedPush
+			}
+			length = int(binary.LittleEndian.Uint16(script[pc:]))
+			pc += 2
+		}
+
+		if length < 0 {
+			instructions = append(instructions, Instruction{Opcode: op})
+			continue
+		}
+
+		if pc+length > len(script) {
+			return nil, ErrMalformedPush
+		}
+		if length > MaxElementSize {
+			return nil, ErrElementTooLarge
+		}
+
+		instructions = append(instructions, Instruction{op, script[pc : pc+length]})
+		pc += length
+	}
+
+	return instructions, nil
+}
+
+// Reports whether the script only pushes data
+func IsPushOnly(script []byte) bool {
+	instructions, err := Parse(script)
+	if err != nil {
+		return false
+	}
+
+	for _, ins := range instructions {
+		if ins.Opcode > OP_16 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the script in a readable form, data pushes as hex
+func Disassemble(script []byte) string {
+	instructions, err := Parse(script)
+	if err != nil {
+		return fmt.Sprintf("[invalid script %x]", script)
+	}
+
+	var parts []string
+	for _, ins := range instructions {
+		switch {
+		case ins.Data != nil:
+			parts = append(parts, fmt.Sprintf("%x", ins.Data))
+		case ins.Opcode >= OP_1 && ins.Opcode <= OP_16:
+			parts = append(parts, fmt.Sprintf("OP_%d", ins.Opcode-OP_1+1))
+		case opcodeNames[ins.Opcode] != "":
+			parts = append(parts, opcodeNames[ins.Opcode])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN_%02x", ins.Opcode))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Assembles a script
+type Builder struct {
+	script []byte
+}
+
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+func (b *Builder) AddOp(op byte) *Builder {
+	b.script = append(b.script, op)
+
+	return b
+}
+
+// Adds the shortest push of the data
+func (b *Builder) AddData(data []byte) *Builder {
+	switch {
+	case len(data) == 0:
+		b.script = append(b.script, OP_0)
+	case len(data) < OP_PUSHDATA1:
+		b.script = append(b.script, byte(len(data)))
+	case len(data) <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		var length [2]byte
+		binary.LittleEndian.PutUint16(length[:], uint16(len(data)))
+		b.script = append(append(b.script, OP_PUSHDATA2), length[:]...)
+	}
+	b.script = append(b.script, data...)
+
+	return b
+}
+
+// Adds a number, using the small integer opcodes where possible
+func (b *Builder) AddInt(n int64) *Builder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(byte(OP_1 + n - 1))
+	}
+
+	return b.AddData(EncodeNumber(n))
+}
+
+func (b *Builder) Script() []byte {
+	return append([]byte{}, b.script...)
+}
+
+// Encodes the number as little endian sign and magnitude in as few bytes as possible
+func EncodeNumber(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+
+	negative := n < 0
+	magnitude := uint64(n)
+	if negative {
+		magnitude = uint64(-n)
+	}
+
+	var result []byte
+	for magnitude > 0 {
+		result = append(result, byte(magnitude))
+		magnitude >>= 8
+	}
+
+	// The top bit of the last byte holds the sign
+	if result[len(result)-1]&0x80 != 0 {
+		if negative {
+			result = append(result, 0x80)
+		} else {
+			result = append(result, 0x00)
+		}
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+// Decodes a number of at most maxSize bytes that was encoded by EncodeNumber
+func DecodeNumber(data []byte, maxSize int) (int64, error) {
+	if len(data) > maxSize {
+		return 0, ErrBadNumber
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	// A last byte holding only the sign is needed only when the byte before uses the top bit
+	last := data[len(data)-1]
+	if last&0x7f == 0 && (len(data) == 1 || data[len(data)-2]&0x80 == 0) {
+		return 0, ErrBadNumber
+	}
+
+	var result int64
+	for i, b := range data {
+		result |= int64(b) << uint(8*i)
+	}
+
+	if last&0x80 != 0 {
+		result &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		return -result, nil
+	}
+
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package script
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNumbersRoundTrip(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 16, 127, 128, -128, 255, 256, -32768, 1<<31 - 1, -(1<<31 - 1), 1 << 32} {
+		decoded, err := DecodeNumber(EncodeNumber(n), 5)
+		if err != nil || decoded != n {
+			t.Fatal("number does not round trip", n, decoded, err)
+		}
+	}
+
+	if encoded := EncodeNumber(128); bytes.Equal(encoded, []byte{0x80, 0x00}) == false {
+		t.Fatalf("128 encoded as %x", encoded)
+	}
+	if encoded := EncodeNumber(-128); bytes.Equal(encoded, []byte{0x80, 0x80}) == false {
+		t.Fatalf("-128 encoded as %x", encoded)
+	}
+}
+
+func TestNonMinimalNumbersAreRejected(t *testing.T) {
+	for _, data := range [][]byte{{0x00}, {0x80}, {0x01, 0x00}, {0x7f, 0x80}} {
+		if _, err := DecodeNumber(data, 4); err != ErrBadNumber {
+			t.Fatalf("%x: expected %v, got %v", data, ErrBadNumber, err)
+		}
+	}
+
+	if _, err := DecodeNumber(EncodeNumber(1<<32), 4); err != ErrBadNumber {
+		t.Fatal("number longer than the limit accepted")
+	}
+}
+
+func TestPushesParseBack(t *testing.T) {
+	var data [][]byte
+	for _, size := range []int{1, 75, 76, 255, 256, MaxElementSize} {
+		data = append(data, bytes.Repeat([]byte{byte(size)}, size))
+	}
+
+	b := NewBuilder()
+	for _, d := range data {
+		b.AddData(d)
+	}
+
+	pushes, ok := ExtractPushes(b.Script())
+	if ok == false || len(pushes) != len(data) {
+		t.Fatal("pushes are not parsed back")
+	}
+	for i := range data {
+		if bytes.Equal(pushes[i], data[i]) == false {
+			t.Fatal("push of", len(data[i]), "bytes changed")
+		}
+	}
+}
+
+func TestMalformedScriptsAreRejected(t *testing.T) {
+	if _, err := Parse([]byte{10, 1, 2}); err != ErrMalformedPush {
+		t.Fatalf("expected %v, got %v", ErrMalformedPush, err)
+	}
+	if _, err := Parse([]byte{OP_PUSHDATA2, 1}); err != ErrMalformedPush {
+		t.Fatalf("expected %v, got %v", ErrMalformedPush, err)
+	}
+	if _, err := Parse(make([]byte, MaxScriptSize+1)); err != ErrScriptTooLong {
+		t.Fatalf("expected %v, got %v", ErrScriptTooLong, err)
+	}
+}
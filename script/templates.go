@@ -0,0 +1,292 @@
+package script
+
+import "bytes"
+
+// Locks to the holder of the key hashing to pubKeyHash
+//
+//	OP_DUP OP_HASH160 <pubkey hash> OP_EQUALVERIFY OP_CHECKSIG
+func PayToPubKeyHash(pubKeyHash []byte) []byte {
+	return NewBuilder().
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// Unlocks a pay-to-pubkey-hash or time lock output
+func PayToPubKeyHashUnlock(sig, pubKey []byte) []byte {
+	return NewBuilder().AddData(sig).AddData(pubKey).Script()
+}
+
+// Returns the pubkey hash of a pay-to-pubkey-hash script, nil for any other script
+func ExtractPubKeyHash(script []byte) []byte {
+	if len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == 20 &&
+		script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG {
+		return append([]byte{}, script[3:23]...)
+	}
+
+	return nil
+}
+
+// Returns the public key of a pay-to-pubkey-hash unlocking script, nil for any other script
+func ExtractPubKey(unlocking []byte) []byte {
+	instructions, err := Parse(unlocking)
+	if err != nil || len(instructions) != 2 || instructions[1].Data == nil {
+		return nil
+	}
+
+	return instructions[1].Data
+}
+
+// Locks to the redeem script hashing to scriptHash. The spending input pushes the
+// redeem script after what the redeem script needs. Redeem scripts are limited to MaxElementSize bytes
+//
+//	OP_HASH160 <script hash> OP_EQUAL
+func PayToScriptHash(scriptHash []byte) []byte {
+	return NewBuilder().AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).Script()
+}
+
+// Returns the script hash of a pay-to-script-hash script, nil for any other script
+func ExtractScriptHash(script []byte) []byte {
+	if len(script) == 23 && script[0] == OP_HASH160 && script[1] == 20 && script[22] == OP_EQUAL {
+		return append([]byte{}, script[2:22]...)
+	}
+
+	return nil
+}
+
+// Unlocks a pay-to-script-hash output whose redeem script is a multisig script
+func MultisigScriptHashUnlock(sigs [][]byte, redeemScript []byte) []byte {
+	b := NewBuilder()
+	for _, sig := range sigs {
+		b.AddData(sig)
+	}
+
+	return b.AddData(redeemScript).Script()
+}
+
+// Returns the pushes of a push-only script
+func ExtractPushes(script []byte) ([][]byte, bool) {
+	instructions, err := Parse(script)
+	if err != nil {
+		return nil, false
+	}
+
+	var pushes [][]byte
+	for _, ins := range instructions {
+		if ins.Data == nil {
+			return nil, false
+		}
+		pushes = append(pushes, ins.Data)
+	}
+
+	return pushes, true
+}
+
+// Locks to m signatures made by different keys out of the public keys
+//
+//	<m> <pubkey 1> ... <pubkey n> <n> OP_CHECKMULTISIG
+func Multisig(m int, pubKeys [][]byte) []byte {
+	b := NewBuilder().AddInt(int64(m))
+	for _, pubKey := range pubKeys {
+		b.AddData(pubKey)
+	}
+
+	return b.AddInt(int64(len(pubKeys))).AddOp(OP_CHECKMULTISIG).Script()
+}
+
+// Unlocks a multisig output. Signatures must be in the order of their keys in the locking script
+func MultisigUnlock(sigs [][]byte) []byte {
+	b := NewBuilder()
+	for _, sig := range sigs {
+		b.AddData(sig)
+	}
+
+	return b.Script()
+}
+
+// Returns m and the public keys of a multisig script
+func ExtractMultisig(script []byte) (int, [][]byte, bool) {
+	instructions, err := Parse(script)
+	if err != nil || len(instructions) < 4 || instructions[len(instructions)-1].Opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	small := func(ins Instruction) int {
+		if ins.Data == nil && ins.Opcode >= OP_1 && ins.Opcode <= OP_16 {
+			return int(ins.Opcode - OP_1 + 1)
+		}
+		return 0
+	}
+
+	m := small(instructions[0])
+	n := small(instructions[len(instructions)-2])
+	keys := instructions[1 : len(instructions)-2]
+
+	if m == 0 || n != len(keys) || m > n {
+		return 0, nil, false
+	}
+
+	var pubKeys [][]byte
+	for _, key := range keys {
+		if key.Data == nil {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, key.Data)
+	}
+
+	// The script must be exactly what Multisig builds
+	if bytes.Equal(Multisig(m, pubKeys), script) == false {
+		return 0, nil, false
+	}
+
+	return m, pubKeys, true
+}
+
+// Locks to the key hashing to pubKeyHash, which must also reveal the preimage of the SHA-256 hash
+//
+//	OP_SHA256 <hash> OP_EQUALVERIFY OP_DUP OP_HASH160 <pubkey hash> OP_EQUALVERIFY OP_CHECKSIG
+func HashLock(hash, pubKeyHash []byte) []byte {
+	return NewBuilder().
+		AddOp(OP_SHA256).AddData(hash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).
+		Script()
+}
+
+func HashLockUnlock(sig, pubKey, preimage []byte) []byte {
+	return NewBuilder().AddData(sig).AddData(pubKey).AddData(preimage).Script()
+}
+
+// Locks to the key hashing to pubKeyHash until the lock time, a block height or a unix time
+//
+//	<lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <pubkey hash> OP_EQUALVERIFY OP_CHECKSIG
+func TimeLock(lockTime int64, pubKeyHash []byte) []byte {
+	return NewBuilder().
+		AddInt(lockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// Locks to the key hashing to pubKeyHash until the output is as old as the relative lock time
+// in the sequence. The spending input must carry at least that sequence
+//
+//	<sequence> OP_CHECKSEQUENCEVERIFY OP_DROP OP_DUP OP_HASH160 <pubkey hash> OP_EQUALVERIFY OP_CHECKSIG
+func RelativeTimeLock(sequence int64, pubKeyHash []byte) []byte {
+	return NewBuilder().
+		AddInt(sequence).AddOp(OP_CHECKSEQUENCEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// Size of the secret of a hash time-locked contract. Fixing it keeps a secret valid on every chain of a swap
+const HTLCSecretSize = 32
+
+// Hash time-locked contract. The recipient unlocks it with the secret hashing to secretHash,
+// the refund key from the lock time on, a block height or a unix time
+//
+//	OP_IF
+//	    OP_SIZE <32> OP_EQUALVERIFY OP_SHA256 <secret hash> OP_EQUALVERIFY OP_DUP OP_HASH160 <recipient pubkey hash>
+//	OP_ELSE
+//	    <lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <refund pubkey hash>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+func HTLC(secretHash, recipientHash []byte, lockTime int64, refundHash []byte) []byte {
+	return NewBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt(HTLCSecretSize).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(secretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(recipientHash).
+		AddOp(OP_ELSE).
+		AddInt(lockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(refundHash).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// Unlocks a hash time-locked contract as its recipient
+func HTLCRedeem(sig, pubKey, secret []byte) []byte {
+	return NewBuilder().AddData(sig).AddData(pubKey).AddData(secret).AddOp(OP_TRUE).Script()
+}
+
+// Unlocks a hash time-locked contract as its refund key
+func HTLCRefund(sig, pubKey []byte) []byte {
+	return NewBuilder().AddData(sig).AddData(pubKey).AddOp(OP_FALSE).Script()
+}
+
+// Returns the secret hash, recipient pubkey hash, lock time and refund pubkey hash of a hash time-locked contract
+func ExtractHTLC(script []byte) ([]byte, []byte, int64, []byte, bool) {
+	instructions, err := Parse(script)
+	if err != nil || len(instructions) != 20 {
+		return nil, nil, 0, nil, false
+	}
+
+	secretHash := instructions[5].Data
+	recipientHash := instructions[9].Data
+	refundHash := instructions[16].Data
+
+	lockTime, err := DecodeNumber(instructions[11].Data, 5)
+	if ins := instructions[11]; ins.Data == nil && ins.Opcode >= OP_1 && ins.Opcode <= OP_16 {
+		lockTime, err = int64(ins.Opcode-OP_1+1), nil
+	}
+	if err != nil || secretHash == nil || recipientHash == nil || refundHash == nil {
+		return nil, nil, 0, nil, false
+	}
+
+	// The script must be exactly what HTLC builds
+	if bytes.Equal(HTLC(secretHash, recipientHash, lockTime, refundHash), script) == false {
+		return nil, nil, 0, nil, false
+	}
+
+	return secretHash, recipientHash, lockTime, refundHash, true
+}
+
+// Returns the secret revealed by an unlocking script redeeming a hash time-locked contract, nil for any other script
+func ExtractHTLCSecret(unlocking []byte) []byte {
+	instructions, err := Parse(unlocking)
+	if err != nil || len(instructions) != 4 || instructions[3].Opcode != OP_TRUE {
+		return nil
+	}
+
+	return instructions[2].Data
+}
+
+// Largest number of bytes a data output carries
+const MaxDataCarrierSize = 80
+
+// Provably unspendable output carrying data
+//
+//	OP_RETURN <data>
+func NullData(data []byte) []byte {
+	return NewBuilder().AddOp(OP_RETURN).AddData(data).Script()
+}
+
+// Reports whether the script can never be unlocked because it starts with OP_RETURN
+func IsUnspendable(script []byte) bool {
+	return len(script) > 0 && script[0] == OP_RETURN
+}
+
+// Returns the data of a data output script of at most MaxDataCarrierSize bytes
+func ExtractNullData(script []byte) ([]byte, bool) {
+	instructions, err := Parse(script)
+	if err != nil || len(instructions) != 2 || instructions[0].Opcode != OP_RETURN {
+		return nil, false
+	}
+
+	data := instructions[1].Data
+	if data == nil && instructions[1].Opcode == OP_0 {
+		data = []byte{}
+	}
+	if data == nil || len(data) > MaxDataCarrierSize {
+		return nil, false
+	}
+
+	// The data must be pushed the way NullData pushes it
+	if bytes.Equal(NullData(data), script) == false {
+		return nil, false
+	}
+
+	return data, true
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"log"
+	"math/big"
 
 	"golang.org/x/crypto/ripemd160"
 )
@@ -14,6 +15,9 @@ import (
 const (
 	checksumLength = 4
 	version        = byte(0x00)
+
+	// Version byte of addresses paying to the hash of a redeem script
+	scriptVersion = byte(0x05)
 )
 
 type Wallet struct {
@@ -25,8 +29,24 @@ func (w Wallet) Address() []byte {
 	// Returns RIPEMD-160 hash
 	pubHash := PublicKeyHash(w.PublicKey)
 
+	return encodeAddress(version, pubHash)
+}
+
+// Returns the pay-to-script-hash address of the redeem script
+func ScriptAddress(redeemScript []byte) []byte {
+	return encodeAddress(scriptVersion, PublicKeyHash(redeemScript))
+}
+
+// Returns the hash the address pays to and whether it is the hash of a redeem script
+func DecodeAddress(address []byte) ([]byte, bool) {
+	fullHash := Base58Decode(address)
+
+	return fullHash[1 : len(fullHash)-checksumLength], fullHash[0] == scriptVersion
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
 	// Add version byte in front of RIPEMD-160 hash
-	versionedHash := append([]byte{version}, pubHash...)
+	versionedHash := append([]byte{version}, hash...)
 
 	// Get 4 bytes checksum
 	checksum := Checksum(versionedHash)
@@ -70,10 +90,53 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 	}
 
 	// Take the corresponding public key generated with it
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pub := EncodePublicKey(private.PublicKey)
 	return *private, pub
 }
 
+// Returns X and Y of the public key, 32 bytes each
+func EncodePublicKey(pub ecdsa.PublicKey) []byte {
+	encoded := make([]byte, 64)
+	pub.X.FillBytes(encoded[:32])
+	pub.Y.FillBytes(encoded[32:])
+
+	return encoded
+}
+
+// Returns the encodings the public key can have. Wallets created before coordinates were
+// padded left out their leading zero bytes, so their public key can be shorter
+func PublicKeyEncodings(pub ecdsa.PublicKey) [][]byte {
+	encoded := EncodePublicKey(pub)
+	unpadded := append(pub.X.Bytes(), pub.Y.Bytes()...)
+
+	if bytes.Equal(encoded, unpadded) {
+		return [][]byte{encoded}
+	}
+
+	return [][]byte{encoded, unpadded}
+}
+
+// Returns the point of an encoded public key. Every split leaving both coordinates
+// at most 32 bytes is tried, as the coordinates of older keys can be shorter
+func decodePublicKey(pubKey []byte) (*ecdsa.PublicKey, bool) {
+	curve := elliptic.P256()
+
+	for split := len(pubKey) - 32; split <= 32; split++ {
+		if split < 0 {
+			continue
+		}
+
+		x := new(big.Int).SetBytes(pubKey[:split])
+		y := new(big.Int).SetBytes(pubKey[split:])
+
+		if curve.IsOnCurve(x, y) {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, true
+		}
+	}
+
+	return nil, false
+}
+
 func MakeWallet() *Wallet {
 	private, public := NewKeyPair()
 	wallet := Wallet{private, public}
@@ -97,6 +160,37 @@ func PublicKeyHash(pubKey []byte) []byte {
 	return publicRipEMD
 }
 
+// Signs the hash with the private key. The signature is r and s, 32 bytes each
+func Sign(privateKey ecdsa.PrivateKey, hash []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &privateKey, hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signature
+}
+
+// Reports whether the signature of the hash was made by the key of the public key
+func VerifySignature(pubKey, hash, signature []byte) bool {
+	if len(signature) != 64 {
+		return false
+	}
+
+	key, ok := decodePublicKey(pubKey)
+	if ok == false {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+
+	return ecdsa.Verify(key, hash, r, s)
+}
+
 func Checksum(payload []byte) []byte {
 	// Perform SHA-256 hash on the extended RIPEMD-160 hash
 	firstHash := sha256.Sum256(payload)
@@ -0,0 +1,50 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// Returns a wallet whose public key has a coordinate with a leading zero byte
+func shortKeyWallet(t *testing.T, shortY bool) *Wallet {
+	for i := 0; i < 100000; i++ {
+		w := MakeWallet()
+		x, y := w.PrivateKey.PublicKey.X.Bytes(), w.PrivateKey.PublicKey.Y.Bytes()
+		if (shortY == false && len(x) < 32 && len(y) == 32) || (shortY && len(y) < 32 && len(x) == 32) {
+			return w
+		}
+	}
+
+	t.Fatal("no short key found")
+	return nil
+}
+
+func TestPublicKeysArePadded(t *testing.T) {
+	for _, shortY := range []bool{false, true} {
+		w := shortKeyWallet(t, shortY)
+		if len(w.PublicKey) != 64 {
+			t.Fatal("public key is not 64 bytes", len(w.PublicKey))
+		}
+
+		hash := sha256.Sum256([]byte("data"))
+		sig := Sign(w.PrivateKey, hash[:])
+
+		encodings := PublicKeyEncodings(w.PrivateKey.PublicKey)
+		if len(encodings) != 2 || bytes.Equal(encodings[0], w.PublicKey) == false {
+			t.Fatal("expected the padded and the unpadded encoding")
+		}
+
+		// Wallets created before padding hold the unpadded encoding
+		for _, pubKey := range encodings {
+			if VerifySignature(pubKey, hash[:], sig) == false {
+				t.Fatalf("signature does not verify with the %d byte key", len(pubKey))
+			}
+		}
+
+		other := MakeWallet()
+		if VerifySignature(other.PublicKey, hash[:], sig) {
+			t.Fatal("signature verifies with another key")
+		}
+	}
+}
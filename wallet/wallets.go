@@ -14,11 +14,15 @@ const walletFile = "/tmp/wallets_%s.data"
 
 type Wallets struct {
 	Wallets map[string]*Wallet
+
+	// Redeem scripts of the pay-to-script-hash addresses the wallets sign for, keyed by address
+	Scripts map[string][]byte
 }
 
 func CreateWallets(nodeId string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Scripts = make(map[string][]byte)
 
 	err := wallets.LoadFile(nodeId)
 
@@ -48,6 +52,43 @@ func (ws Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+// Returns the wallet holding the public key, nil if there is none
+func (ws Wallets) FindWallet(pubKey []byte) *Wallet {
+	for _, wallet := range ws.Wallets {
+		if bytes.Equal(wallet.PublicKey, pubKey) {
+			return wallet
+		}
+	}
+
+	return nil
+}
+
+// Returns the wallet whose public key hashes to pubKeyHash, nil if there is none
+func (ws Wallets) FindWalletByHash(pubKeyHash []byte) *Wallet {
+	for _, wallet := range ws.Wallets {
+		if bytes.Equal(PublicKeyHash(wallet.PublicKey), pubKeyHash) {
+			return wallet
+		}
+	}
+
+	return nil
+}
+
+// Stores the redeem script and returns its address
+func (ws *Wallets) AddScript(redeemScript []byte) string {
+	address := fmt.Sprintf("%s", ScriptAddress(redeemScript))
+
+	ws.Scripts[address] = redeemScript
+
+	return address
+}
+
+func (ws Wallets) GetScript(address string) ([]byte, bool) {
+	redeemScript, ok := ws.Scripts[address]
+
+	return redeemScript, ok
+}
+
 func (ws *Wallets) LoadFile(nodeId string) error {
 	walletFile := fmt.Sprintf(walletFile, nodeId)
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
@@ -70,6 +111,11 @@ func (ws *Wallets) LoadFile(nodeId string) error {
 
 	ws.Wallets = wallets.Wallets
 
+	// Files written before redeem scripts were stored have none
+	if wallets.Scripts != nil {
+		ws.Scripts = wallets.Scripts
+	}
+
 	return nil
 }
 